@@ -0,0 +1,124 @@
+package main
+
+import "strings"
+
+// NOTE: when expanding bare $VAR references we have to leave Go template
+//       actions alone, since "{{ $x := ... }}" is full of dollar signs
+//       that aren't ours. This is just enough of text/template's lexer
+//       to find where an action ends: it knows about comments, and
+//       about quoted, raw and character strings (which may contain a
+//       "}}" of their own).
+//
+//       It's also how we find the comments that mark regions of the
+//       input not to expand at all:
+//
+//       {{/* gosubst:noexpand */}} ... {{/* gosubst:expand */}}
+
+// The region markers, as the text of a template comment.
+const (
+	noexpandMarker = "gosubst:noexpand"
+	expandMarker   = "gosubst:expand"
+)
+
+// actionLength returns the length of the template action that begins
+// s (which must start with "{{"), including its delimiters. If the
+// action is never closed the rest of s is taken to be the action.
+func actionLength(s string) int {
+	i := 2
+	if strings.HasPrefix(s[i:], "- ") {
+		i += 2
+	}
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+
+	// Comments are "{{/*" ... "*/}}", and may not contain actions.
+	if strings.HasPrefix(s[i:], "/*") {
+		end := strings.Index(s[i+2:], "*/")
+		if end < 0 {
+			return len(s)
+		}
+		i += 2 + end + 2
+		if closing := strings.Index(s[i:], "}}"); closing >= 0 {
+			return i + closing + 2
+		}
+		return len(s)
+	}
+
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			quote := s[i]
+			for i++; i < len(s) && s[i] != quote && s[i] != '\n'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '`':
+			end := strings.IndexByte(s[i+1:], '`')
+			if end < 0 {
+				return len(s)
+			}
+			i += end + 1
+		case '}':
+			if i+1 < len(s) && s[i+1] == '}' {
+				return i + 2
+			}
+		}
+	}
+	return len(s)
+}
+
+// comment returns the text of the template comment that begins s (with
+// the spaces around it trimmed), and its length including the
+// delimiters, or false if s doesn't begin with a whole comment.
+func comment(s string) (string, int, bool) {
+	if !strings.HasPrefix(s, "{{") {
+		return "", 0, false
+	}
+	i := 2
+	if strings.HasPrefix(s[i:], "- ") {
+		i += 2
+	}
+	if !strings.HasPrefix(s[i:], "/*") {
+		return "", 0, false
+	}
+	end := strings.Index(s[i+2:], "*/")
+	if end < 0 {
+		return "", 0, false
+	}
+	text := strings.TrimSpace(s[i+2 : i+2+end])
+	i += 2 + end + 2
+	rest := strings.TrimPrefix(s[i:], " -")
+	if !strings.HasPrefix(rest, "}}") {
+		return "", 0, false
+	}
+	return text, len(s) - len(rest) + 2, true
+}
+
+// regionEnd returns the offset in s of the marker that ends a noexpand
+// region, or -1 if there isn't one.
+func regionEnd(s string) int {
+	for i := 0; ; i += 2 {
+		open := strings.Index(s[i:], "{{")
+		if open < 0 {
+			return -1
+		}
+		i += open
+		if text, _, ok := comment(s[i:]); ok && text == expandMarker {
+			return i
+		}
+	}
+}
+
+// regionCut returns how much of s, the start of a noexpand region that
+// hasn't ended yet, can't be the start of the marker that ends it.
+func regionCut(s string) int {
+	if open := strings.LastIndex(s, "{{"); open >= 0 && !strings.Contains(s[open:], "}}") {
+		return open
+	}
+	if strings.HasSuffix(s, "{") {
+		return len(s) - 1
+	}
+	return len(s)
+}
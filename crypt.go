@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"gopkg.in/yaml.v2"
+)
+
+// NOTE: encrypted values are how secrets can be committed alongside the
+//       templates that use them. A key is 32 random bytes, base64'd (so
+//       `head -c 32 /dev/urandom | base64` makes one), which is taken as
+//       an X25519 private key. Each value is sealed with nacl/box to its
+//       public key, from a new ephemeral key, and written as
+//
+//       ENC[box:BASE64]
+//
+//       where BASE64 is the ephemeral public key, the nonce and the box.
+//       What's sealed is the value as JSON, so that it decrypts to the
+//       same type it was (eg 3 and not "3"). Only the leaves of a values
+//       file are encrypted: its keys, and so its shape, are left clear.
+
+// KeyEnv is the environment variable a key can be given in, if there's
+// no key file.
+const KeyEnv = "GOSUBST_KEY"
+
+// encPrefix and encSuffix wrap an encrypted value.
+const (
+	encPrefix = "ENC[box:"
+	encSuffix = "]"
+)
+
+// Key is a key for encrypted values.
+type Key struct {
+	private [32]byte
+	public  [32]byte
+}
+
+// ParseKey parses a key: 32 bytes, base64'd. Blank lines and comments
+// (lines starting with "#") around it are ignored.
+func ParseKey(s string) (*Key, error) {
+	var text string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+		if text != "" {
+			return nil, errors.New("invalid key: more than one line")
+		}
+		text = line
+	}
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(data) != 32 {
+		return nil, errors.New("invalid key: must be 32 bytes, base64'd")
+	}
+	key := &Key{}
+	copy(key.private[:], data)
+	curve25519.ScalarBaseMult(&key.public, &key.private)
+	return key, nil
+}
+
+// LoadKey reads and parses the key file at path (through FsBackend).
+func LoadKey(path string) (*Key, error) {
+	data, err := afero.ReadFile(FsBackend, path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return key, nil
+}
+
+// IsEncrypted reports whether val is an encrypted value.
+func IsEncrypted(val interface{}) bool {
+	s, ok := val.(string)
+	return ok && strings.HasPrefix(s, encPrefix) && strings.HasSuffix(s, encSuffix)
+}
+
+// Encrypt encrypts val, returning it as "ENC[box:...]".
+func (key *Key) Encrypt(val interface{}) (string, error) {
+	msg, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+	out := append(public[:], nonce[:]...)
+	out = box.Seal(out, msg, &nonce, &key.public, private)
+	return encPrefix + base64.StdEncoding.EncodeToString(out) + encSuffix, nil
+}
+
+// Decrypt decrypts a value encrypted by Encrypt.
+func (key *Key) Decrypt(s string) (interface{}, error) {
+	if !IsEncrypted(s) {
+		return nil, errors.New("not an encrypted value")
+	}
+	data, err := base64.StdEncoding.DecodeString(s[len(encPrefix) : len(s)-len(encSuffix)])
+	if err != nil || len(data) < 32+24+box.Overhead {
+		return nil, errors.New("malformed encrypted value")
+	}
+	var public [32]byte
+	var nonce [24]byte
+	copy(public[:], data)
+	copy(nonce[:], data[32:])
+	msg, ok := box.Open(nil, data[32+24:], &nonce, &public, &key.private)
+	if !ok {
+		return nil, errors.New("can't decrypt it: wrong key, or it's been tampered with")
+	}
+	var val interface{}
+	if err := yaml.Unmarshal(msg, &val); err != nil {
+		return nil, err
+	}
+	return normalize(val), nil
+}
+
+// DecryptValues decrypts every encrypted value in values, in place. If
+// there are any, key mustn't be nil.
+func DecryptValues(values map[string]interface{}, key *Key) error {
+	_, err := mapLeaves(values, "", func(val interface{}, path string) (interface{}, error) {
+		if !IsEncrypted(val) {
+			return val, nil
+		}
+		if key == nil {
+			return nil, fmt.Errorf("%s: is encrypted, but there's no key (give --key-file, or set $%s)", path, KeyEnv)
+		}
+		dec, err := key.Decrypt(val.(string))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return dec, nil
+	})
+	return err
+}
+
+// mapLeaves replaces each leaf (anything but a map or a list) of val,
+// which is at the JSON pointer path, with what fn returns for it.
+func mapLeaves(val interface{}, path string, fn func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	var err error
+	switch val := val.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(val) {
+			if val[k], err = mapLeaves(val[k], path+"/"+escapePointer(k), fn); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	case yaml.MapSlice:
+		for i, item := range val {
+			if val[i].Value, err = mapLeaves(item.Value, path+"/"+escapePointer(fmt.Sprint(item.Key)), fn); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	case []interface{}:
+		for i := range val {
+			if val[i], err = mapLeaves(val[i], fmt.Sprintf("%s/%d", path, i), fn); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	}
+	return fn(val, path)
+}
+
+// cryptValues encrypts (or decrypts) the leaves of the values file in
+// data, returning it rewritten. JSON files (as named) stay JSON, and
+// anything else is YAML. The order of keys is kept, but not comments.
+func cryptValues(name string, data []byte, key *Key, decrypt bool) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	_, err := mapLeaves(doc, "", func(val interface{}, path string) (interface{}, error) {
+		var err error
+		switch {
+		case decrypt && IsEncrypted(val):
+			val, err = key.Decrypt(val.(string))
+		case !decrypt && val != nil && !IsEncrypted(val):
+			val, err = key.Encrypt(val)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return val, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(name) == ".json" {
+		out, err := json.MarshalIndent(orderedJSON{doc}, "", "  ")
+		return append(out, '\n'), err
+	}
+	return yaml.Marshal(doc)
+}
+
+// orderedJSON marshals a value parsed as a yaml.MapSlice to JSON, keeping
+// the order of its keys.
+type orderedJSON struct {
+	val interface{}
+}
+
+func (o orderedJSON) MarshalJSON() ([]byte, error) {
+	switch val := o.val.(type) {
+	case yaml.MapSlice:
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, item := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(fmt.Sprint(item.Key))
+			v, err := json.Marshal(orderedJSON{item.Value})
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(v)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	case []interface{}:
+		list := make([]orderedJSON, len(val))
+		for i, item := range val {
+			list[i] = orderedJSON{item}
+		}
+		return json.Marshal(list)
+	}
+	return json.Marshal(o.val)
+}
+
+// Crypt runs the encrypt and decrypt subcommands, where args are the
+// command line arguments from the subcommand's name on, eg
+//
+//	encrypt --key-file=gosubst.key values.secret.yaml
+//
+// Each values file named is encrypted (or decrypted) in place (through
+// FsBackend), or if none are, in is written to out. The key is from
+// --key-file, or else is envKey (ie $GOSUBST_KEY).
+func Crypt(args []string, envKey string, in io.Reader, out io.Writer) error {
+	decrypt := args[0] == "decrypt"
+	var keyFile string
+	var paths []string
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--key-file":
+			if i+1 >= len(args) {
+				return errors.New("invalid options: --key-file requires an argument")
+			}
+			i++
+			keyFile = args[i]
+		case strings.HasPrefix(arg, "--key-file="):
+			keyFile = arg[len("--key-file="):]
+		case len(arg) > 1 && strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("invalid options: unrecognized option %q", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+
+	var key *Key
+	var err error
+	switch {
+	case keyFile != "":
+		key, err = LoadKey(keyFile)
+	case envKey != "":
+		key, err = ParseKey(envKey)
+	default:
+		err = fmt.Errorf("%s needs a key: give --key-file, or set $%s", args[0], KeyEnv)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		if data, err = cryptValues("", data, key, decrypt); err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+	for _, path := range paths {
+		data, err := afero.ReadFile(FsBackend, path)
+		if err != nil {
+			return err
+		}
+		if data, err = cryptValues(path, data, key, decrypt); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		mode := os.FileMode(0600)
+		if stat, err := FsBackend.Stat(path); err == nil {
+			mode = stat.Mode()
+		}
+		if err := afero.WriteFile(FsBackend, path, data, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/spf13/afero"
+)
+
+// Keys are just 32 random bytes, base64'd.
+const (
+	testKey  = "# for tests only\nq0nXYbo0TsgJ/UYD6CmqD2Zj7KSNR5ZXkdVzHqwrPlE=\n"
+	otherKey = "9p5dTf8X/Nm0xvfe3hC5Yg9W2nQ0V5ElKBiNA1bXdDw="
+)
+
+func TestKey(t *testing.T) {
+	key, err := gosubst.ParseKey(testKey)
+	if err != nil {
+		t.Fatalf("ParseKey() has error %q; expected nil", err)
+	}
+	other, err := gosubst.ParseKey(otherKey)
+	if err != nil {
+		t.Fatalf("ParseKey() has error %q; expected nil", err)
+	}
+
+	for _, val := range []interface{}{"hunter2", "3", 3, 1.5, true, "", "ENC[box:]", "multi\nline"} {
+		enc, err := key.Encrypt(val)
+		if err != nil {
+			t.Errorf("Encrypt(%#v) has error %q; expected nil", val, err)
+			continue
+		}
+		if !gosubst.IsEncrypted(enc) || strings.Contains(enc, "hunter2") {
+			t.Errorf("Encrypt(%#v) == %q; expected it to be encrypted", val, enc)
+		}
+		if again, _ := key.Encrypt(val); again == enc {
+			t.Errorf("Encrypt(%#v) twice == %q; expected them to differ", val, enc)
+		}
+		if dec, err := key.Decrypt(enc); err != nil || !reflect.DeepEqual(dec, val) {
+			t.Errorf("Decrypt(Encrypt(%#v)) == %#v, %v; expected it back", val, dec, err)
+		}
+		if _, err := other.Decrypt(enc); err == nil || !strings.Contains(err.Error(), "wrong key") {
+			t.Errorf("Decrypt() with the wrong key has error %v; expected it to fail", err)
+		}
+		tampered := enc[:len(enc)-4] + "AAA]"
+		if _, err := key.Decrypt(tampered); err == nil {
+			t.Errorf("Decrypt(%q) has no error; expected it to be tampered with", tampered)
+		}
+	}
+
+	errs := []struct {
+		key, err string
+	}{
+		{"", "must be 32 bytes"},
+		{"c2hvcnQ=", "must be 32 bytes"},
+		{"not base64!", "must be 32 bytes"},
+		{otherKey + "\n" + otherKey, "more than one line"},
+	}
+	for _, test := range errs {
+		if _, err := gosubst.ParseKey(test.key); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseKey(%q) has error %v; expected %q", test.key, err, test.err)
+		}
+	}
+	if _, err := key.Decrypt("ENC[box:c2hvcnQ=]"); err == nil || err.Error() != "malformed encrypted value" {
+		t.Errorf("Decrypt() of a short value has error %v; expected it to be malformed", err)
+	}
+}
+
+func TestCrypt(t *testing.T) {
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "gosubst.key", []byte(testKey), 0600)
+	afero.WriteFile(gosubst.FsBackend, "other.key", []byte(otherKey), 0600)
+	secrets := "db:\n  user: app\n  password: hunter2\n  port: 5432\napi_keys:\n- abc\n- def\nempty: null\n"
+	afero.WriteFile(gosubst.FsBackend, "secrets.yaml", []byte(secrets), 0640)
+	afero.WriteFile(gosubst.FsBackend, "secrets.json", []byte(`{"z": "last", "a": {"b": [1, "two"]}}`), 0644)
+	afero.WriteFile(gosubst.FsBackend, "values.yaml", []byte("db:\n  host: localhost\n"), 0644)
+
+	if err := gosubst.Crypt([]string{"encrypt", "--key-file", "gosubst.key", "secrets.yaml", "secrets.json"}, "", nil, nil); err != nil {
+		t.Fatalf("Crypt(encrypt) has error %q; expected nil", err)
+	}
+	data, _ := afero.ReadFile(gosubst.FsBackend, "secrets.yaml")
+	enc := string(data)
+	for _, clear := range []string{"db:\n  user: ENC[box:", "\n  password: ENC[box:", "\napi_keys:\n- ENC[box:", "\nempty: null\n"} {
+		if !strings.Contains(enc, clear) {
+			t.Errorf("encrypted secrets.yaml == %q; expected it to have %q", enc, clear)
+		}
+	}
+	if strings.Contains(enc, "hunter2") || strings.Contains(enc, "5432") {
+		t.Errorf("encrypted secrets.yaml == %q; expected its values encrypted", enc)
+	}
+	if stat, _ := gosubst.FsBackend.Stat("secrets.yaml"); stat.Mode() != 0640 {
+		t.Errorf("encrypted secrets.yaml has mode %v; expected it kept", stat.Mode())
+	}
+	data, _ = afero.ReadFile(gosubst.FsBackend, "secrets.json")
+	if json := string(data); !strings.HasPrefix(json, "{\n  \"z\": \"ENC[box:") || !strings.Contains(json, "\"a\": {\n    \"b\": [\n      \"ENC[box:") {
+		t.Errorf("encrypted secrets.json == %q; expected JSON, in order", json)
+	}
+
+	// Encrypting again leaves what's encrypted alone.
+	if err := gosubst.Crypt([]string{"encrypt", "secrets.yaml"}, testKey, nil, nil); err != nil {
+		t.Fatalf("Crypt(encrypt) has error %q; expected nil", err)
+	}
+	if data, _ := afero.ReadFile(gosubst.FsBackend, "secrets.yaml"); string(data) != enc {
+		t.Errorf("encrypted again, secrets.yaml == %q; expected it unchanged", data)
+	}
+
+	// Rendering decrypts.
+	opts := gosubst.DefaultOptions()
+	opts.Values = []string{"values.yaml", "secrets.yaml"}
+	opts.KeyFile = "gosubst.key"
+	input := "{{ .Values.db.user }}:{{ .Values.db.password }}@{{ .Values.db.host }}:{{ add .Values.db.port 1 }} {{ .Values.api_keys }}"
+	output, err := gosubst.Render(input, opts)
+	if expected := "app:hunter2@localhost:5433 [abc def]"; err != nil || output != expected {
+		t.Errorf("Render(%q) == %q, %v; expected %q", input, output, err, expected)
+	}
+	opts.KeyFile, opts.Key = "", testKey
+	if output, err := gosubst.Render(input, opts); err != nil || output != "app:hunter2@localhost:5433 [abc def]" {
+		t.Errorf("Render() with a Key == %q, %v; expected it decrypted", output, err)
+	}
+
+	renderErrs := []struct {
+		keyFile, key, err string
+	}{
+		{"", "", "invalid values: /api_keys/0: is encrypted, but there's no key (give --key-file, or set $GOSUBST_KEY)"},
+		{"other.key", "", "invalid values: /api_keys/0: can't decrypt it: wrong key, or it's been tampered with"},
+		{"nope.key", "", "invalid key file: open nope.key: file does not exist"},
+		{"", "oops", "invalid $GOSUBST_KEY: invalid key: must be 32 bytes, base64'd"},
+	}
+	for _, test := range renderErrs {
+		opts.KeyFile, opts.Key = test.keyFile, test.key
+		if _, err := gosubst.Render(input, opts); err == nil || err.Error() != test.err {
+			t.Errorf("Render() with key file %q and key %q has error %v; expected %q", test.keyFile, test.key, err, test.err)
+		}
+	}
+
+	// Decrypting gives the values back, for editing.
+	if err := gosubst.Crypt([]string{"decrypt", "--key-file=gosubst.key", "secrets.yaml"}, "", nil, nil); err != nil {
+		t.Fatalf("Crypt(decrypt) has error %q; expected nil", err)
+	}
+	if data, _ := afero.ReadFile(gosubst.FsBackend, "secrets.yaml"); string(data) != secrets {
+		t.Errorf("decrypted secrets.yaml ==\n%s\nexpected\n%s", data, secrets)
+	}
+
+	// Without any files, it's a filter.
+	var out bytes.Buffer
+	if err := gosubst.Crypt([]string{"encrypt"}, testKey, strings.NewReader("a: 1\n"), &out); err != nil || !strings.HasPrefix(out.String(), "a: ENC[box:") {
+		t.Errorf("Crypt(encrypt) from stdin == %q, %v; expected it encrypted", out.String(), err)
+	}
+	enc = out.String()
+	out.Reset()
+	if err := gosubst.Crypt([]string{"decrypt"}, testKey, strings.NewReader(enc), &out); err != nil || out.String() != "a: 1\n" {
+		t.Errorf("Crypt(decrypt) from stdin == %q, %v; expected it decrypted", out.String(), err)
+	}
+
+	errs := []struct {
+		args []string
+		key  string
+		err  string
+	}{
+		{[]string{"encrypt", "secrets.yaml"}, "", "encrypt needs a key: give --key-file, or set $GOSUBST_KEY"},
+		{[]string{"decrypt", "--key-file"}, "", "--key-file requires an argument"},
+		{[]string{"decrypt", "-x"}, testKey, `unrecognized option "-x"`},
+		{[]string{"decrypt", "nope.yaml"}, testKey, "file does not exist"},
+		{[]string{"decrypt", "--key-file=other.key", "secrets.json"}, "", "secrets.json: /z: can't decrypt it"},
+	}
+	for _, test := range errs {
+		if err := gosubst.Crypt(test.args, test.key, nil, nil); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Crypt(%q) has error %v; expected %q", test.args, err, test.err)
+		}
+	}
+}
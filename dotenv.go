@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// NOTE: dotenv files are a lot like shell scripts full of assignments,
+//       but they're not shell scripts, so sourcing them breaks on all
+//       sorts of quoting. This follows what docker compose and the
+//       dotenv libraries agree on:
+//
+//       # a comment
+//       export NAME=value        "export" is optional, and ignored
+//       NAME=value # comment     unquoted values end at " #", and are
+//                                trimmed
+//       NAME="a ${OTHER}\n"      double quotes allow escapes (\n, \t,
+//                                \r, \", \\ and \$) and references
+//       NAME='as it is'          single quotes allow neither
+//       NAME="line 1
+//       line 2"                  quoted values may span lines
+//
+//       References (${VAR} or $VAR, with any of the operators) are to
+//       the variables as they stand so far: the real environment first,
+//       and then what's been loaded, including earlier in the same file.
+//       The real environment always wins, and later files override
+//       earlier ones.
+
+// Env is the environment as seen through dotenv files: variables loaded
+// from them are layered under the real environment.
+type Env struct {
+	// Lookup looks up variables in the real environment (eg with
+	// os.LookupEnv). If it's nil, only the loaded variables are seen.
+	Lookup func(string) (string, bool)
+
+	vars  map[string]string
+	names []string // the loaded variables, in the order first loaded
+}
+
+// NewEnv returns an Env with nothing loaded over the real environment
+// that lookup looks up.
+func NewEnv(lookup func(string) (string, bool)) *Env {
+	return &Env{Lookup: lookup}
+}
+
+// LookupEnv returns the value of the named variable, reporting whether
+// it's set at all, with the real environment taking precedence.
+func (env *Env) LookupEnv(name string) (string, bool) {
+	if env.Lookup != nil {
+		if val, ok := env.Lookup(name); ok {
+			return val, true
+		}
+	}
+	val, ok := env.vars[name]
+	return val, ok
+}
+
+// Loaded returns the names of the variables loaded from dotenv files,
+// in the order they were first loaded.
+func (env *Env) Loaded() []string {
+	return env.names
+}
+
+// set records a variable loaded from a file, overriding any loaded
+// before it.
+func (env *Env) set(name, val string) {
+	if env.vars == nil {
+		env.vars = make(map[string]string)
+	}
+	if _, ok := env.vars[name]; !ok {
+		env.names = append(env.names, name)
+	}
+	env.vars[name] = val
+}
+
+// LoadFile loads the dotenv file at path (through FsBackend).
+func (env *Env) LoadFile(path string) error {
+	data, err := afero.ReadFile(FsBackend, path)
+	if err != nil {
+		return err
+	}
+	return env.Load(path, string(data))
+}
+
+// Load parses s, the contents of the dotenv file called name, loading
+// its variables. Errors give the line they're on, as "name:line: ...".
+// As in Docker Compose, values only refer to variables: a scheme like
+// ${cmd:...}, or a filter like ${X|sh}, in an unquoted or double-quoted
+// value is an error.
+func (env *Env) Load(name, s string) error {
+	e := NewExpander(env.LookupEnv) // with no Resolvers or SystemFilters
+	e.Bare = true
+	line := 1
+	for s != "" {
+		entry := strings.TrimLeft(s, " \t")
+		n, key, val, err := parseEnvEntry(entry, e)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", name, line, err)
+		}
+		if key != "" {
+			env.set(key, val)
+		}
+		n += len(s) - len(entry)
+		line += strings.Count(s[:n], "\n")
+		s = s[n:]
+	}
+	return nil
+}
+
+// parseEnvEntry parses the line (or lines, for a quoted value) at the
+// start of s, returning how much of s it takes up (up to and including
+// its newline) and the variable it sets, if any.
+func parseEnvEntry(s string, e *Expander) (int, string, string, error) {
+	end := strings.IndexByte(s, '\n') + 1
+	if end == 0 {
+		end = len(s)
+	}
+	if strings.TrimSpace(s[:end]) == "" || s[0] == '#' {
+		return end, "", "", nil
+	}
+
+	rest := s
+	if strings.HasPrefix(rest, "export ") || strings.HasPrefix(rest, "export\t") {
+		rest = strings.TrimLeft(rest[len("export"):], " \t")
+	}
+	key, w := getShellName(rest)
+	if key == "" || !isName(key) || !isNameStart(key[0]) {
+		return 0, "", "", fmt.Errorf("invalid variable name in %q", strings.TrimSpace(s[:end]))
+	}
+	rest = strings.TrimLeft(rest[w:], " \t")
+	if !strings.HasPrefix(rest, "=") {
+		return 0, "", "", fmt.Errorf("%s: missing \"=\"", key)
+	}
+	rest = strings.TrimLeft(rest[1:], " \t")
+	at := len(s) - len(rest) // where the value starts
+
+	var val string
+	var err error
+	if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+		var n int
+		if n, val, err = parseEnvQuoted(rest, e); err != nil {
+			return 0, "", "", fmt.Errorf("%s: %s", key, err)
+		}
+		// Only a comment may follow the closing quote.
+		at += n
+		end = at + strings.IndexByte(s[at:], '\n') + 1
+		if end == at {
+			end = len(s)
+		}
+		if after := strings.TrimSpace(s[at:end]); after != "" && after[0] != '#' {
+			return 0, "", "", fmt.Errorf("%s: unexpected %q after the closing quote", key, after)
+		}
+		return end, key, val, nil
+	}
+
+	raw := strings.TrimRight(s[at:end], "\r\n")
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && (i == 0 || raw[i-1] == ' ' || raw[i-1] == '\t') {
+			raw = raw[:i]
+			break
+		}
+	}
+	if val, err = e.Expand(strings.TrimSpace(raw)); err != nil {
+		return 0, "", "", fmt.Errorf("%s: %s", key, err)
+	}
+	return end, key, val, nil
+}
+
+// envEscapes are the escapes allowed in double quotes.
+var envEscapes = map[byte]string{'n': "\n", 't': "\t", 'r': "\r", '"': `"`, '\\': `\`, '$': "$"}
+
+// parseEnvQuoted parses the quoted value at the start of s, returning
+// how much of s it takes up (including the quotes) and its value.
+func parseEnvQuoted(s string, e *Expander) (int, string, error) {
+	quote := s[0]
+	if quote == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return 0, "", fmt.Errorf("unterminated quote")
+		}
+		return end + 2, s[1 : end+1], nil
+	}
+
+	// Expand each run of text between escapes, so that what's escaped
+	// isn't expanded.
+	var b strings.Builder
+	start := 1
+	flush := func(end int) error {
+		val, err := e.Expand(s[start:end])
+		b.WriteString(val)
+		return err
+	}
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && envEscapes[s[i+1]] != "":
+			if err := flush(i); err != nil {
+				return 0, "", err
+			}
+			b.WriteString(envEscapes[s[i+1]])
+			i++
+			start = i + 1
+		case s[i] == '"':
+			if err := flush(i); err != nil {
+				return 0, "", err
+			}
+			return i + 1, b.String(), nil
+		}
+	}
+	return 0, "", fmt.Errorf("unterminated quote")
+}
+
+// LoadEnvFiles loads the dotenv files at the given paths, in order, and
+// sets any of their variables that aren't already set in the process's
+// environment, so that the expansion, requiredEnvs and the template's
+// env functions (and any commands run) all see them.
+func LoadEnvFiles(paths ...string) error {
+	env := NewEnv(os.LookupEnv)
+	for _, path := range paths {
+		if err := env.LoadFile(path); err != nil {
+			return err
+		}
+	}
+	return env.Export()
+}
+
+// Export sets the loaded variables in the process's environment, except
+// for those the real environment already has.
+func (env *Env) Export() error {
+	for _, name := range env.names {
+		if env.Lookup != nil {
+			if _, ok := env.Lookup(name); ok {
+				continue
+			}
+		}
+		if err := os.Setenv(name, env.vars[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/hews/gosubst/internal/testutils"
+	"github.com/spf13/afero"
+)
+
+func TestEnvLoad(t *testing.T) {
+	input := strings.Join([]string{
+		"# comment",
+		"",
+		"PLAIN=value",
+		"  export EXPORTED = spaced out  ",
+		"COMMENTED=value # comment",
+		"HASH=a#b",
+		`DOUBLE="a \"b\" \\ \$NOPE\n\t#c" # comment`,
+		`SINGLE='${PLAIN} \n "x"'`,
+		`SINGLE_CMD='${cmd:echo ran}'`,
+		`MULTI="line 1`,
+		`line 2"`,
+		`MULTI_SINGLE='one`,
+		`two'`,
+		"REF=${PLAIN}-$EXPORTED",
+		`QREF="${MULTI_SINGLE:0:3}${UNSET:-default}"`,
+		"REAL=${HOME}",
+		"HOME=/nope",
+		"EMPTY=",
+		"EMPTY_QUOTED=''",
+		"CRLF=value\r",
+		"PLAIN=again",
+	}, "\n")
+
+	env := gosubst.NewEnv(func(name string) (string, bool) {
+		if name == "HOME" {
+			return "/home/gopher", true
+		}
+		return "", false
+	})
+	if err := env.Load(".env", input); err != nil {
+		t.Fatalf("Env.Load() has error %q; expected nil", err)
+	}
+
+	expected := []struct{ name, val string }{
+		{"PLAIN", "again"},
+		{"EXPORTED", "spaced out"},
+		{"COMMENTED", "value"},
+		{"HASH", "a#b"},
+		{"DOUBLE", "a \"b\" \\ $NOPE\n\t#c"},
+		{"SINGLE", `${PLAIN} \n "x"`},
+		{"SINGLE_CMD", "${cmd:echo ran}"},
+		{"MULTI", "line 1\nline 2"},
+		{"MULTI_SINGLE", "one\ntwo"},
+		{"REF", "value-spaced out"},
+		{"QREF", "onedefault"},
+		{"REAL", "/home/gopher"},
+		{"HOME", "/home/gopher"},
+		{"EMPTY", ""},
+		{"EMPTY_QUOTED", ""},
+		{"CRLF", "value"},
+	}
+	if loaded := env.Loaded(); len(loaded) != len(expected) {
+		t.Errorf("Env.Loaded() == %q; expected %d variables", loaded, len(expected))
+	}
+	for _, test := range expected {
+		if val, ok := env.LookupEnv(test.name); !ok || val != test.val {
+			t.Errorf("Env.LookupEnv(%q) == %q, %t; expected %q, true", test.name, val, ok, test.val)
+		}
+	}
+
+	errs := []struct {
+		input, err string
+	}{
+		{"A=1\nB=\"open\n\nC=3", `.env:2: B: unterminated quote`},
+		{"A='x' y", `.env:1: A: unexpected "y" after the closing quote`},
+		{"A=1\n  NOPE\n", `.env:2: NOPE: missing "="`},
+		{"A-B=1", `.env:1: A: missing "="`},
+		{"1A=1", `.env:1: invalid variable name in "1A=1"`},
+		{"A=${B:?is required}", `.env:1: A: ${B}: is required`},
+		{"A=${cmd:echo ran; echo x}", `.env:1: A: ${cmd:echo ran; echo x}: scheme "cmd" isn't allowed here`},
+		{"B=\"${cmd:echo hi}\"", `.env:1: B: ${cmd:echo hi}: scheme "cmd" isn't allowed here`},
+		{"A=${file:/etc/passwd}", `.env:1: A: ${file:/etc/passwd}: scheme "file" isn't allowed here`},
+		{"A=${NOPE:-touch nope|sh}", `.env:1: A: ${NOPE:-touch nope|sh}: filter "sh" isn't allowed`},
+	}
+	for _, test := range errs {
+		if err := gosubst.NewEnv(nil).Load(".env", test.input); err == nil || err.Error() != test.err {
+			t.Errorf("Env.Load(%q) has error %v; expected %q", test.input, err, test.err)
+		}
+	}
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	resetEnvirnonment := testutils.ClearEnvironment(t)
+	defer resetEnvirnonment()
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, ".env", []byte("APP_NAME=app\nAPP_PORT=80\nAPP_ENV=dev\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, ".env.local", []byte("APP_PORT=8080\nAPP_URL=http://${APP_NAME}:${APP_PORT}/${APP_ENV}\n"), 0644)
+	os.Setenv("APP_ENV", "prod")
+
+	if err := gosubst.LoadEnvFiles(".env", ".env.local"); err != nil {
+		t.Fatalf("LoadEnvFiles() has error %q; expected nil", err)
+	}
+	for name, val := range map[string]string{
+		"APP_NAME": "app",
+		"APP_PORT": "8080",
+		"APP_ENV":  "prod",
+		"APP_URL":  "http://app:8080/prod",
+	} {
+		if os.Getenv(name) != val {
+			t.Errorf("after LoadEnvFiles(), $%s == %q; expected %q", name, os.Getenv(name), val)
+		}
+	}
+
+	// Both passes see the loaded variables.
+	out, err := gosubst.Render(`${APP_URL} {{ requiredEnvs "APP_NAME" }}{{ env "APP_PORT" }}`, gosubst.DefaultOptions())
+	if err != nil || out != "http://app:8080/prod 8080" {
+		t.Errorf("Render() after LoadEnvFiles() == %q, %v; expected the loaded variables", out, err)
+	}
+
+	if err := gosubst.LoadEnvFiles(".env.nope"); err == nil || !strings.Contains(err.Error(), "file does not exist") {
+		t.Errorf("LoadEnvFiles() with a missing file has error %v; expected it to not exist", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// NOTE: rather than threading a filtered environment through every pass
+//       (and Sprig's env and expandenv, which only know os.Getenv), the
+//       process's own environment is cleaned, as `env -i` would, before
+//       any dotenv files are loaded into it. Everything that looks at the
+//       environment then sees the same variables: the expansion,
+//       requiredEnvs, .Env, env and expandenv, and the commands run by
+//       sh() and ${cmd:...}.
+
+// CleanEnv clears the process's environment of every variable except
+// those with names matching one of the pass patterns (shell patterns,
+// eg "APP_*").
+func CleanEnv(pass ...string) error {
+	// Find sh while there's still a $PATH to find it with, so that sh()
+	// keeps working without one.
+	if path, err := exec.LookPath(shell); err == nil {
+		shell = path
+	}
+
+	filter := VarFilter{Only: pass}
+	environ := os.Environ()
+	os.Clearenv()
+	for _, envvar := range environ {
+		pair := strings.SplitN(envvar, "=", 2)
+		if len(pair) < 2 || len(pass) == 0 || !filter.Allows(pair[0]) {
+			continue
+		}
+		if err := os.Setenv(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Environment gathers the .Env values: the process's environment, as a
+// map of names to values. The values are all strings, but the map is of
+// interface{}s so that Sprig's dict functions (hasKey and co) work on it.
+func Environment() map[string]interface{} {
+	env := make(map[string]interface{})
+	for _, envvar := range os.Environ() {
+		if pair := strings.SplitN(envvar, "=", 2); len(pair) == 2 {
+			env[pair[0]] = pair[1]
+		}
+	}
+	return env
+}
@@ -0,0 +1,57 @@
+package main_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/hews/gosubst/internal/testutils"
+)
+
+func TestCleanEnv(t *testing.T) {
+	resetEnvirnonment := testutils.ClearEnvironment(t)
+	defer resetEnvirnonment()
+
+	os.Setenv("APP_NAME", "app")
+	os.Setenv("APP_PORT", "80")
+	os.Setenv("NGINX_VERSION", "1.19")
+	os.Setenv("SECRET", "shh")
+
+	if err := gosubst.CleanEnv("APP_*", "NGINX_VERSION"); err != nil {
+		t.Fatalf("CleanEnv() has error %q; expected nil", err)
+	}
+	expected := map[string]interface{}{"APP_NAME": "app", "APP_PORT": "80", "NGINX_VERSION": "1.19"}
+	if env := gosubst.Environment(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("after CleanEnv(), Environment() == %v; expected %v", env, expected)
+	}
+
+	// Every pass sees only what's left, and sh() still works without a
+	// $PATH.
+	tests := []struct {
+		input, output string
+	}{
+		{"${APP_NAME}:${SECRET}:${HOME}", "app::"},
+		{`{{ env "APP_PORT" }}{{ env "SECRET" }}`, "80"},
+		{`{{ expandenv "$NGINX_VERSION$SECRET" }}`, "1.19"},
+		{`{{ sh "echo $APP_NAME$SECRET" | trim }}`, "app"},
+		{`{{ .Env.APP_NAME }} {{ hasKey .Env "SECRET" }} {{ len .Env }}`, "app false 3"},
+		{`{{ range $k, $v := .Env }}{{ $k }}={{ $v }};{{ end }}`, "APP_NAME=app;APP_PORT=80;NGINX_VERSION=1.19;"},
+	}
+	for _, test := range tests {
+		output, err := gosubst.Render(test.input, gosubst.DefaultOptions())
+		if err != nil || output != test.output {
+			t.Errorf("Render(%q) == %q, %v; expected %q", test.input, output, err, test.output)
+		}
+	}
+	if _, err := gosubst.RequiredEnvs("SECRET"); err == nil {
+		t.Errorf("RequiredEnvs(\"SECRET\") after CleanEnv() has no error; expected it to be missing")
+	}
+
+	if err := gosubst.CleanEnv(); err != nil {
+		t.Fatalf("CleanEnv() has error %q; expected nil", err)
+	}
+	if env := gosubst.Environment(); len(env) != 0 {
+		t.Errorf("after CleanEnv() with nothing to pass, Environment() == %v; expected it empty", env)
+	}
+}
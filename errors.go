@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Undefined is a reference to an unset (or empty) variable, found in
+// Strict mode.
+type Undefined struct {
+	Name   string // the variable's name
+	Text   string // the reference as written, eg "${NAME}"
+	Line   int    // the line of the input it's on
+	Column int    // the column (in characters) of the line it's at
+	Empty  bool   // whether it's set, but empty
+}
+
+// UndefinedError lists every reference to an unset variable found in
+// the input during a Strict expansion.
+type UndefinedError struct {
+	Refs []Undefined
+}
+
+func (e *UndefinedError) Error() string {
+	msgs := make([]string, len(e.Refs))
+	for i, ref := range e.Refs {
+		what := "is not set"
+		if ref.Empty {
+			what = "is empty"
+		}
+		msgs[i] = fmt.Sprintf("%d:%d: %s %s", ref.Line, ref.Column, ref.Text, what)
+	}
+	if len(msgs) == 1 {
+		return "undefined variable: " + msgs[0]
+	}
+	return fmt.Sprintf("%d undefined variables:\n  %s", len(msgs), strings.Join(msgs, "\n  "))
+}
+
+// BadSyntax is a malformed reference, found with RejectBadSyntax.
+type BadSyntax struct {
+	Offset  int    // the byte offset in the input it starts at
+	Line    int    // the line of the input it's on
+	Column  int    // the column (in characters) of the line it's at
+	Snippet string // the malformed text
+	Reason  string // what's wrong with it
+}
+
+// SyntaxError lists every malformed reference found in the input during
+// an expansion with RejectBadSyntax.
+type SyntaxError struct {
+	Refs []BadSyntax
+}
+
+func (e *SyntaxError) Error() string {
+	msgs := make([]string, len(e.Refs))
+	for i, ref := range e.Refs {
+		msgs[i] = fmt.Sprintf("%d:%d: %s: %q", ref.Line, ref.Column, ref.Reason, ref.Snippet)
+	}
+	if len(msgs) == 1 {
+		return "bad syntax: " + msgs[0]
+	}
+	return fmt.Sprintf("%d syntax errors:\n  %s", len(msgs), strings.Join(msgs, "\n  "))
+}
+
+// maxSnippet is the most of the input quoted by a BadSyntax.
+const maxSnippet = 32
+
+// snippet returns the start of s to quote in an error: the first n
+// bytes, or if that's too little to be useful, up to the end of the
+// line, but never more than maxSnippet characters.
+func snippet(s string, n int) string {
+	if n <= 2 {
+		n = len(s)
+		if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+			n = nl
+		}
+	}
+	str := s[:n]
+	if utf8.RuneCountInString(str) > maxSnippet {
+		str = string([]rune(str)[:maxSnippet]) + "..."
+	}
+	return str
+}
+
+// position returns the 1-indexed line and column of the given byte
+// offset in s, counting columns in characters rather than bytes.
+func position(s string, offset int) (int, int) {
+	if offset > len(s) {
+		offset = len(s)
+	}
+	before := s[:offset]
+	line := strings.Count(before, "\n") + 1
+	col := utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return line, col
+}
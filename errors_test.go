@@ -0,0 +1,45 @@
+package main_test
+
+import (
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+func TestUndefinedError(t *testing.T) {
+	one := &gosubst.UndefinedError{Refs: []gosubst.Undefined{
+		{Name: "A", Text: "${A}", Line: 1, Column: 3},
+	}}
+	expected := "undefined variable: 1:3: ${A} is not set"
+	if one.Error() != expected {
+		t.Errorf("UndefinedError.Error() == %q; expected %q", one.Error(), expected)
+	}
+
+	two := &gosubst.UndefinedError{Refs: []gosubst.Undefined{
+		{Name: "A", Text: "${A}", Line: 1, Column: 3},
+		{Name: "B", Text: "$B", Line: 4, Column: 1, Empty: true},
+	}}
+	expected = "2 undefined variables:\n  1:3: ${A} is not set\n  4:1: $B is empty"
+	if two.Error() != expected {
+		t.Errorf("UndefinedError.Error() == %q; expected %q", two.Error(), expected)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	one := &gosubst.SyntaxError{Refs: []gosubst.BadSyntax{
+		{Offset: 4, Line: 1, Column: 5, Snippet: "${}", Reason: "empty name"},
+	}}
+	expected := `bad syntax: 1:5: empty name: "${}"`
+	if one.Error() != expected {
+		t.Errorf("SyntaxError.Error() == %q; expected %q", one.Error(), expected)
+	}
+
+	two := &gosubst.SyntaxError{Refs: []gosubst.BadSyntax{
+		{Offset: 4, Line: 1, Column: 5, Snippet: "${}", Reason: "empty name"},
+		{Offset: 9, Line: 2, Column: 1, Snippet: "${x", Reason: "unterminated reference"},
+	}}
+	expected = "2 syntax errors:\n  1:5: empty name: \"${}\"\n  2:1: unterminated reference: \"${x\""
+	if two.Error() != expected {
+		t.Errorf("SyntaxError.Error() == %q; expected %q", two.Error(), expected)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// NOTE: escaping makes sure an expanded value can't break the structure
+//       of the file it's expanded into. The right way to escape a value
+//       depends on where it's going (inside a quoted string, say), so we
+//       look at the text around each reference:
+//
+//       yaml   in a quoted scalar, the value is escaped for its quotes;
+//              in a block scalar (after "key: |"), its lines are
+//              indented to match; as a whole plain scalar, it's left
+//              alone if that's safe (and it reads back as the same
+//              string, or number, not eg null, a boolean or an octal),
+//              double-quoted if it isn't, and made a literal block
+//              scalar (indented to match) if it has more than one line;
+//              in a comment it's left alone
+//       json   in a string, the value is escaped for it; elsewhere it's
+//              left alone if it's valid JSON already (eg a number), and
+//              made into a string if not
+//       shell  in quotes, the value is escaped for them; elsewhere it's
+//              single-quoted, unless it's safe as it is
+//       xml    the value is escaped as character data, or in an
+//              attribute, or in a CDATA section
+//
+//       Only the text on the same line is looked at (except to find the
+//       start of a YAML block scalar), and no more than maxContext bytes
+//       of it.
+
+// maxContext is the most of the output before a reference, and of the
+// input after it, that's looked at to decide how to escape its value.
+const maxContext = 4096
+
+// Escaping says how an Expander escapes the values it expands, to suit
+// the format of its output.
+type Escaping int
+
+// The Escaping options.
+const (
+	EscapeNone Escaping = iota
+	EscapeYAML
+	EscapeJSON
+	EscapeShell
+	EscapeXML
+)
+
+// escapings are the Escapings by name.
+var escapings = map[string]Escaping{
+	"none":  EscapeNone,
+	"yaml":  EscapeYAML,
+	"json":  EscapeJSON,
+	"shell": EscapeShell,
+	"xml":   EscapeXML,
+}
+
+// ParseEscaping returns the Escaping named "yaml", "json", "shell", "xml"
+// or "none".
+func ParseEscaping(name string) (Escaping, error) {
+	if esc, ok := escapings[name]; ok {
+		return esc, nil
+	}
+	return EscapeNone, fmt.Errorf("invalid escaping %q: must be yaml, json, shell, xml or none", name)
+}
+
+// escape escapes val to suit where it's going: after the text before,
+// and followed by the text after (up to the end of its line).
+func (esc Escaping) escape(val, before, after string) (string, error) {
+	line := before[strings.LastIndexByte(before, '\n')+1:]
+	switch esc {
+	case EscapeYAML:
+		return escapeYAML(val, before, line, after)
+	case EscapeJSON:
+		return escapeJSON(val, line), nil
+	case EscapeShell:
+		return escapeShell(val, line), nil
+	case EscapeXML:
+		return escapeXML(val, before), nil
+	}
+	return val, nil
+}
+
+var (
+	// yamlOtherTypes matches plain scalars that other YAML parsers (of
+	// YAML 1.2, or of all of 1.1, like PyYAML) don't read as strings,
+	// though yaml.v2 does: 0o octals, exponents without a ".",
+	// sexagesimals and timestamps.
+	yamlOtherTypes = regexp.MustCompile(`^(?:[-+]?0o[0-7_]+|[-+]?(?:\.[0-9]+|[0-9]+(?:\.[0-9]*)?)[eE][-+]?[0-9]+|[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+(?:\.[0-9_]*)?|[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}(?:[Tt ].*)?)$`)
+	// yamlKey matches the start of a line up to where a scalar begins,
+	// capturing the indentation (including any "- " entries).
+	yamlKey = regexp.MustCompile(`^( *(?:- +)*)(?:[^ #].*:[ \t]+)?$`)
+	// yamlEnd matches the end of a line after a whole scalar.
+	yamlEnd = regexp.MustCompile(`^(?:[ \t]+#.*|[ \t]*)$`)
+	// yamlFlowStart and yamlFlowEnd match either side of a scalar in a
+	// flow collection, like [a, b] or {a: b}.
+	yamlFlowStart = regexp.MustCompile(`(?:[\[{,]|:)[ \t]*$`)
+	yamlFlowEnd   = regexp.MustCompile(`^[ \t]*[,\]}]`)
+	// yamlBlockHeader matches a line that starts a block scalar.
+	yamlBlockHeader = regexp.MustCompile(`(?:^|[ :-])[|>][-+0-9]*[ \t]*(?:#.*)?$`)
+)
+
+// errPlainYAML is returned for values that can't be expanded as part of
+// a plain (unquoted) YAML scalar.
+var errPlainYAML = errors.New("value can't be escaped inside of a plain YAML scalar; quote the scalar")
+
+// escapeYAML escapes val for YAML, where line is the start of the line
+// that it's on.
+func escapeYAML(val, before, line, after string) (string, error) {
+	switch yamlQuote(line) {
+	case '#':
+		return val, nil
+	case '"':
+		quoted := strconv.Quote(val)
+		return quoted[1 : len(quoted)-1], nil
+	case '\'':
+		// A single line break is folded into a space, so double them.
+		indent := "\n\n" + strings.Repeat(" ", indentation(line)+2)
+		return strings.ReplaceAll(strings.ReplaceAll(val, "'", "''"), "\n", indent), nil
+	}
+
+	if indent, ok := yamlBlock(before, line); ok {
+		return indentLines(val, indent), nil
+	}
+	if yamlFlow(line) {
+		if !yamlFlowStart.MatchString(line) || !yamlFlowEnd.MatchString(after) {
+			return plainYAML(val, after)
+		}
+		if yamlPlainSafe(val, true) {
+			return val, nil
+		}
+		return strconv.Quote(val), nil
+	}
+	key := yamlKey.FindStringSubmatch(line)
+	if key == nil || !yamlEnd.MatchString(after) {
+		return plainYAML(val, after)
+	}
+	if strings.Contains(val, "\n") && strings.TrimSpace(after) == "" {
+		// The block is indented relative to its key, or for a sequence
+		// entry (like "  - |"), to the entry's "-".
+		parent := len(key[1])
+		if len(key[1]) == len(line) {
+			parent = strings.LastIndexByte(line, '-')
+			if parent < 0 {
+				parent = 0
+			}
+		}
+		return yamlLiteral(val, len(key[1])+2, parent), nil
+	}
+	if yamlPlainSafe(val, false) {
+		return val, nil
+	}
+	return strconv.Quote(val), nil
+}
+
+// plainYAML checks that val can be written as it is inside of a larger
+// plain scalar, followed by after.
+func plainYAML(val, after string) (string, error) {
+	if strings.ContainsAny(val, "\r\n") || strings.Contains(val, ": ") || strings.Contains(val, " #") ||
+		strings.HasSuffix(val, ":") && (after == "" || after[0] == ' ' || after[0] == '\t') {
+		return "", errPlainYAML
+	}
+	return val, nil
+}
+
+// yamlQuote returns the quote (' or ") that the end of line is inside of,
+// '#' if it's in a comment, or 0.
+func yamlQuote(line string) byte {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		start := i == 0 || strings.IndexByte(" \t[{,", line[i-1]) >= 0
+		switch {
+		case quote == '\'':
+			if c == '\'' && i+1 < len(line) && line[i+1] == '\'' {
+				i++
+			} else if c == '\'' {
+				quote = 0
+			}
+		case quote == '"':
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quote = 0
+			}
+		case c == '#' && start:
+			return '#'
+		case (c == '\'' || c == '"') && start:
+			quote = c
+		}
+	}
+	return quote
+}
+
+// yamlFlow reports whether the end of line is inside of a flow
+// collection.
+func yamlFlow(line string) bool {
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// yamlBlock reports whether line, following before, is inside of a block
+// scalar, and if so, its indentation.
+func yamlBlock(before, line string) (string, bool) {
+	indent := indentation(line)
+	rest := before[:len(before)-len(line)]
+	for rest != "" {
+		rest = rest[:len(rest)-1] // the newline
+		prev := rest[strings.LastIndexByte(rest, '\n')+1:]
+		rest = rest[:len(rest)-len(prev)]
+		if strings.TrimSpace(prev) == "" || indentation(prev) >= indent {
+			continue
+		}
+		if yamlBlockHeader.MatchString(prev) {
+			return line[:indent], true
+		}
+		break
+	}
+	return "", false
+}
+
+// yamlLiteral returns val as a literal block scalar, with its lines
+// indented by indent spaces, where its parent node is indented by parent.
+func yamlLiteral(val string, indent, parent int) string {
+	header := "|"
+	if strings.HasPrefix(val, " ") {
+		header += strconv.Itoa(indent - parent)
+	}
+	body := strings.TrimSuffix(val, "\n")
+	switch trimmed := strings.TrimRight(val, "\n"); len(val) - len(trimmed) {
+	case 0:
+		header += "-"
+	case 1:
+	default:
+		header += "+"
+	}
+	prefix := strings.Repeat(" ", indent)
+	return header + "\n" + prefix + indentLines(body, prefix)
+}
+
+// yamlPlainSafe reports whether val can be written as a plain scalar
+// (in a flow collection, if flow is set) and read back as it is: as a
+// string, or as a number (which is left unquoted on purpose, so that
+// "port: ${PORT}" is still a number).
+func yamlPlainSafe(val string, flow bool) bool {
+	if val == "" || val != strings.TrimSpace(val) {
+		return false
+	}
+	for _, c := range val {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+	if strings.IndexByte("-?:", val[0]) >= 0 {
+		if len(val) == 1 || val[1] == ' ' {
+			return false
+		}
+	} else if strings.IndexByte(",[]{}#&*!|>'\"%@`", val[0]) >= 0 {
+		return false
+	}
+	if flow && strings.ContainsAny(val, ",[]{}") {
+		return false
+	}
+	if strings.Contains(val, ": ") || strings.Contains(val, " #") || strings.HasSuffix(val, ":") {
+		return false
+	}
+	// As YAML 1.1 (and so yaml.v2, and Kubernetes) has it, "null", "~",
+	// "yes", "off" and the like aren't strings, and numbers like "0123"
+	// (octal) or "1.10" don't read back as they were written.
+	if yamlOtherTypes.MatchString(val) {
+		return false
+	}
+	var resolved interface{}
+	if err := yaml.Unmarshal([]byte(val), &resolved); err != nil {
+		return false
+	}
+	switch resolved := resolved.(type) {
+	case string:
+		return resolved == val
+	case int:
+		return strconv.Itoa(resolved) == val
+	case int64:
+		return strconv.FormatInt(resolved, 10) == val
+	case uint64:
+		return strconv.FormatUint(resolved, 10) == val
+	case float64:
+		return strconv.FormatFloat(resolved, 'g', -1, 64) == val
+	}
+	return false
+}
+
+// indentation returns the number of spaces at the start of line, where
+// a "- " for a sequence entry counts as indentation too.
+func indentation(line string) int {
+	n := len(line) - len(strings.TrimLeft(line, " "))
+	for strings.HasPrefix(line[n:], "- ") {
+		n += 2
+		n += len(line[n:]) - len(strings.TrimLeft(line[n:], " "))
+	}
+	return n
+}
+
+// indentLines adds the indent to the start of every line of s after the
+// first, except for empty ones.
+func indentLines(s, indent string) string {
+	lines := strings.Split(s, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			lines[i] = indent + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// escapeJSON escapes val for JSON, where line is the start of the line
+// that it's on.
+func escapeJSON(val, line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		if quoted && line[i] == '\\' {
+			i++
+		} else if line[i] == '"' {
+			quoted = !quoted
+		}
+	}
+	if !quoted && json.Valid([]byte(val)) {
+		return val
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(val) // strings always encode
+	str := strings.TrimSuffix(b.String(), "\n")
+	if quoted {
+		return str[1 : len(str)-1]
+	}
+	return str
+}
+
+var (
+	// shellSafe matches the values that don't need quoting in the shell.
+	shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+	// shellDouble escapes the characters that are special in "...".
+	shellDouble = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+)
+
+// escapeShell escapes val for the shell, where line is the start of the
+// line that it's on.
+func escapeShell(val, line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		}
+	}
+
+	switch {
+	case quote == '\'':
+		return strings.ReplaceAll(val, "'", `'\''`)
+	case quote == '"':
+		return shellDouble.Replace(val)
+	case shellSafe.MatchString(val):
+		return val
+	}
+	return "'" + strings.ReplaceAll(val, "'", `'\''`) + "'"
+}
+
+var (
+	// xmlText escapes character data, and xmlAttr attribute values.
+	xmlText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+	xmlAttr = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;",
+		"\n", "&#xA;", "\r", "&#xD;", "\t", "&#x9;")
+)
+
+// escapeXML escapes val for XML, where before is the text that comes
+// before it.
+func escapeXML(val, before string) string {
+	if cdata := strings.LastIndex(before, "<![CDATA["); cdata >= 0 && !strings.Contains(before[cdata:], "]]>") {
+		return strings.ReplaceAll(val, "]]>", "]]]]><![CDATA[>")
+	}
+	if strings.LastIndexByte(before, '<') > strings.LastIndexByte(before, '>') {
+		return xmlAttr.Replace(val)
+	}
+	return xmlText.Replace(val)
+}
@@ -0,0 +1,149 @@
+package main_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"gopkg.in/yaml.v2"
+)
+
+func testEscapeEnv(s string) (string, bool) {
+	val, ok := map[string]string{
+		"PASSWORD": `p: a"ss #'w\rd`,
+		"CERT":     "-----BEGIN-----\nMIIB\n\n-----END-----",
+		"LINES":    "a\nb\n",
+		"PORT":     "8080",
+		"NEG":      "-1",
+		"DASH":     "- x",
+		"NAME":     "nginx",
+		"TAG":      "1.17",
+		"EMPTY":    "",
+		"OBJ":      `{"a": 1}`,
+		"MARKUP":   `<a href="x">Tom & Jerry's</a>`,
+		"CDATA":    "x]]>y",
+		"NULL":     "null",
+		"TILDE":    "~",
+		"YES":      "yes",
+		"OFF":      "Off",
+		"TRUE":     "true",
+		"SPACED":   "  a\nb",
+		"OCTAL":    "0123",
+		"VERSION":  "1.10",
+	}[s]
+	return val, ok
+}
+
+var escapeTests = []struct {
+	esc     gosubst.Escaping
+	in, out string
+}{
+	// YAML, as whole scalars...
+	{gosubst.EscapeYAML, "password: ${PASSWORD}", `password: "p: a\"ss #'w\\rd"`},
+	{gosubst.EscapeYAML, "port: ${PORT} # the port", "port: 8080 # the port"},
+	{gosubst.EscapeYAML, "n: ${NEG}\nd: ${DASH}", "n: -1\nd: \"- x\""},
+	{gosubst.EscapeYAML, "e: ${EMPTY}", `e: ""`},
+	{gosubst.EscapeYAML, "pw: ${NULL}\nt: ${TILDE}\ny: ${YES}\no: ${OFF}\nb: ${TRUE}", "pw: \"null\"\nt: \"~\"\ny: \"yes\"\no: \"Off\"\nb: \"true\""},
+	{gosubst.EscapeYAML, "a: [${NULL}, ${YES}, ${NAME}]", `a: ["null", "yes", nginx]`},
+	{gosubst.EscapeYAML, "o: ${OCTAL}\nv: ${VERSION}\nt: ${TAG}", "o: \"0123\"\nv: \"1.10\"\nt: 1.17"},
+	{gosubst.EscapeYAML, "- ${PORT}\n- ${PASSWORD}", "- 8080\n- \"p: a\\\"ss #'w\\\\rd\""},
+	{gosubst.EscapeYAML, "tls:\n  cert: ${CERT}\n  key: x", "tls:\n  cert: |-\n    -----BEGIN-----\n    MIIB\n\n    -----END-----\n  key: x"},
+	{gosubst.EscapeYAML, "- l: ${LINES}\n", "- l: |\n    a\n    b\n"},
+	{gosubst.EscapeYAML, "k: ${SPACED}\nl:\n  - ${SPACED}\n", "k: |2-\n    a\n  b\nl:\n  - |4-\n        a\n      b\n"},
+	{gosubst.EscapeYAML, "c: ${CERT} # x", `c: "-----BEGIN-----\nMIIB\n\n-----END-----" # x`},
+	// ... in quotes, comments and block scalars...
+	{gosubst.EscapeYAML, `p: "${PASSWORD}"`, `p: "p: a\"ss #'w\\rd"`},
+	{gosubst.EscapeYAML, `p: '${PASSWORD}'`, `p: 'p: a"ss #''w\rd'`},
+	{gosubst.EscapeYAML, `p: it's ${NAME}`, `p: it's nginx`},
+	{gosubst.EscapeYAML, "# ${PASSWORD}", `# p: a"ss #'w\rd`},
+	{gosubst.EscapeYAML, "cert: |\n  ${CERT}\n", "cert: |\n  -----BEGIN-----\n  MIIB\n\n  -----END-----\n"},
+	{gosubst.EscapeYAML, "cert: >-\n\n    x\n    ${LINES}", "cert: >-\n\n    x\n    a\n    b\n"},
+	// ... in flow collections, and as part of a plain scalar.
+	{gosubst.EscapeYAML, "a: [${PORT}, ${PASSWORD}]", `a: [8080, "p: a\"ss #'w\\rd"]`},
+	{gosubst.EscapeYAML, "image: ${NAME}:${TAG}", "image: nginx:1.17"},
+
+	{gosubst.EscapeJSON, `{"p": "${PASSWORD}", "port": ${PORT}}`, `{"p": "p: a\"ss #'w\\rd", "port": 8080}`},
+	{gosubst.EscapeJSON, `{"n": ${NAME}, "o": ${OBJ}, "e": ${EMPTY}}`, `{"n": "nginx", "o": {"a": 1}, "e": ""}`},
+	{gosubst.EscapeJSON, `{"c": "${CERT}", "m": "${MARKUP}"}`, `{"c": "-----BEGIN-----\nMIIB\n\n-----END-----", "m": "<a href=\"x\">Tom & Jerry's</a>"}`},
+
+	{gosubst.EscapeShell, `PASSWORD=${PASSWORD}`, `PASSWORD='p: a"ss #'\''w\rd'`},
+	{gosubst.EscapeShell, `echo "${PASSWORD}" '${PASSWORD}' ${NAME} ${EMPTY}`, `echo "p: a\"ss #'w\\rd" 'p: a"ss #'\''w\rd' nginx ''`},
+	{gosubst.EscapeShell, `echo "it's" ${MARKUP}`, `echo "it's" '<a href="x">Tom & Jerry'\''s</a>'`},
+
+	{gosubst.EscapeXML, `<p title="${MARKUP}">${MARKUP}</p>`, `<p title="&lt;a href=&quot;x&quot;&gt;Tom &amp; Jerry&apos;s&lt;/a&gt;">&lt;a href=&quot;x&quot;&gt;Tom &amp; Jerry&apos;s&lt;/a&gt;</p>`},
+	{gosubst.EscapeXML, "<p a='${LINES}'>${LINES}</p>", "<p a='a&#xA;b&#xA;'>a\nb\n</p>"},
+	{gosubst.EscapeXML, `<![CDATA[${CDATA}]]>`, `<![CDATA[x]]]]><![CDATA[>y]]>`},
+
+	// Per-reference overrides, and no escaping.
+	{gosubst.EscapeNone, "p: ${PASSWORD@yaml}\nn: ${MARKUP@Q}", "p: \"p: a\\\"ss #'w\\\\rd\"\nn: '<a href=\"x\">Tom & Jerry'\\''s</a>'"},
+	{gosubst.EscapeNone, `x ${PASSWORD}`, `x p: a"ss #'w\rd`},
+	{gosubst.EscapeYAML, `{"p": "${PASSWORD@json}", "q": "${PASSWORD@none}"}`, `{"p": "p: a\"ss #'w\\rd", "q": "p: a"ss #'w\rd"}`},
+	{gosubst.EscapeYAML, `x: ${UNSET:-${PASSWORD}}`, `x: "p: a\"ss #'w\\rd"`},
+}
+
+func TestExpanderEscape(t *testing.T) {
+	for _, test := range escapeTests {
+		e := gosubst.NewExpander(testEscapeEnv)
+		e.Escape = test.esc
+		result, err := e.Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) with escaping %d ==\n%s\nexpected\n%s", test.in, test.esc, result, test.out)
+		}
+		checkStream(t, e, test.in)
+	}
+
+	e := gosubst.NewExpander(testEscapeEnv)
+	e.Escape = gosubst.EscapeYAML
+	for _, in := range []string{"url: http://${PASSWORD}/x", "x: a${CERT}"} {
+		if _, err := e.Expand(in); err == nil || !strings.Contains(err.Error(), "quote the scalar") {
+			t.Errorf("Expander.Expand(%q) has error %v; expected it can't be escaped", in, err)
+		}
+	}
+	if _, err := e.Expand("${NAME@toml}"); err != nil {
+		t.Errorf("Expander.Expand() with an invalid escaping has error %q; expected nil", err)
+	}
+}
+
+func TestEscapeYAMLReadsBack(t *testing.T) {
+	e := gosubst.NewExpander(testEscapeEnv)
+	e.Escape = gosubst.EscapeYAML
+	tests := []struct {
+		in       string
+		expected interface{}
+	}{
+		{"${SPACED}", "  a\nb"},
+		{"k: ${SPACED}", map[interface{}]interface{}{"k": "  a\nb"}},
+		{"- ${SPACED}", []interface{}{"  a\nb"}},
+		{"l:\n  - ${SPACED}", map[interface{}]interface{}{"l": []interface{}{"  a\nb"}}},
+		{"- - ${SPACED}", []interface{}{[]interface{}{"  a\nb"}}},
+		{"- l: ${SPACED}", []interface{}{map[interface{}]interface{}{"l": "  a\nb"}}},
+		{"- [${NULL}, ${YES}]\n- ${TILDE}", []interface{}{[]interface{}{"null", "yes"}, "~"}},
+		{"- ${OCTAL}\n- ${VERSION}\n- ${PORT}", []interface{}{"0123", "1.10", 8080}},
+	}
+	for _, test := range tests {
+		out, err := e.Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+			continue
+		}
+		var actual interface{}
+		if err := yaml.Unmarshal([]byte(out), &actual); err != nil || !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expander.Expand(%q) == %q, which reads back as %#v, %v; expected %#v", test.in, out, actual, err, test.expected)
+		}
+	}
+
+	// Anything that could be read as something other than the string it
+	// is (by yaml.v2, or by another parser) is quoted.
+	for _, val := range []string{"0123", "0x1F", "0o17", "+1", "1_000", "1e3", "1.0", ".inf", "-.Inf", ".NaN", "~", "Null", "yes", "N", "on", "OFF", "1:20", "2001-12-14", "2001-12-14t21:59:43.10-05:00"} {
+		e := gosubst.NewExpander(func(string) (string, bool) { return val, true })
+		e.Escape = gosubst.EscapeYAML
+		if out, err := e.Expand("v: ${V}"); err != nil || out != "v: "+strconv.Quote(val) {
+			t.Errorf("Expander.Expand() of %q == %q, %v; expected it quoted", val, out, err)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
-// NOTE: all of the below is copied, with a few changes, from
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// NOTE: all of the below started out copied, with a few changes, from
 //       https://golang.org/src/os/env.go (go1.13). In essence, I want
 //       to replicate os.ExpandEnv(), but only targeting variables of
 //       the form:
@@ -10,41 +17,822 @@ package main
 //       ... excepting also the case of:
 //
 //       $${VAR_NAME} (which becomes ${VAR_NAME} in the output).
+//
+//       On top of that we understand the POSIX parameter operators, so
+//       that files written for the shell (or envsubst) work unchanged:
+//
+//       ${VAR:-word}  use word if VAR is unset or empty
+//       ${VAR:=word}  as above, but also assign word to VAR
+//       ${VAR:+word}  use word if VAR is set and not empty
+//       ${VAR:?word}  fail with the message word if VAR is unset or empty
+//
+//       Leaving off the colon (eg ${VAR-word}) only tests for unset.
+//
+//       As well as bash's string operators (see pattern.go for the
+//       globbing rules):
+//
+//       ${#VAR}             the length of VAR
+//       ${VAR#pat}          remove the shortest prefix matching pat
+//       ${VAR##pat}         remove the longest prefix matching pat
+//       ${VAR%pat}          remove the shortest suffix matching pat
+//       ${VAR%%pat}         remove the longest suffix matching pat
+//       ${VAR/pat/rep}      replace the first match of pat with rep
+//       ${VAR//pat/rep}     replace every match of pat with rep
+//       ${VAR/#pat/rep}     replace pat if it matches the start of VAR
+//       ${VAR/%pat/rep}     replace pat if it matches the end of VAR
+//       ${VAR:offset}       the characters of VAR from offset on
+//       ${VAR:offset:len}   at most len characters of VAR from offset
+//
+//       And bash 4's case conversions, where pat (if given) restricts
+//       which characters are converted:
+//
+//       ${VAR^pat}          upper-case the first character
+//       ${VAR^^pat}         upper-case every character
+//       ${VAR,pat}          lower-case the first character
+//       ${VAR,,pat}         lower-case every character
+//
+//       And a transformation of our own, to escape the value for the
+//       format of the output, where format is one of yaml, json, shell
+//       (or bash's Q), xml or none (see escape.go):
+//
+//       ${VAR@format}
+//
+//       Any of them may be followed by a pipeline of filters, as in
+//       ${NAME|lower|trunc 63} (see pipeline.go).
+//
+//       A reference may name a scheme instead of a variable, as in
+//       ${file:/run/secrets/db}, to get its value from elsewhere (see
+//       resolver.go).
+//
+//       The name itself may be made up of references, as in
+//       ${DB_${DEPLOY_ENV}_HOST}, and ${!REF} refers to the variable
+//       named by the value of REF (any operator then applies to that
+//       variable). Neither works with syntaxes whose delimiters don't
+//       nest, like "@VAR@".
+//
+//       Nothing between {{/* gosubst:noexpand */}} and the next
+//       {{/* gosubst:expand */}} (if any) is expanded, and with
+//       SkipLiterals, nothing in a template comment or raw string is
+//       either (see actions.go).
+
+// Expander expands ${var} references in a string. Unlike Expand, it can
+// tell unset variables from empty ones, remembers values assigned with
+// ${VAR:=word}, and reports failed ${VAR:?word} references as errors.
+type Expander struct {
+	// Lookup retrieves the value of the named variable, reporting
+	// whether it is set at all (as with os.LookupEnv).
+	Lookup func(string) (string, bool)
+
+	// Bare also expands references of the form $VAR (with the same
+	// name rules as os.Expand), as envsubst does. Since "$" is rife in
+	// Go templates, bare references inside of {{ ... }} actions are
+	// left alone, and "$$VAR" escapes to "$VAR".
+	Bare bool
+
+	// Allow, if set, reports whether the named variable may be
+	// expanded. References to any others are left as they are.
+	Allow func(string) bool
+
+	// Strict makes it an error (like "set -u") to reference a variable
+	// that isn't set, unless an operator like ${VAR:-word} handles it.
+	// Every such reference is reported at once, in an *UndefinedError.
+	// Unless AllowEmpty is also set, empty variables count as unset.
+	Strict     bool
+	AllowEmpty bool
+
+	// Syntax sets the delimiters of references, and how to escape them.
+	// If it's the zero value, DefaultSyntax is used.
+	Syntax Syntax
+
+	// OnBadSyntax says what to do with malformed references, like "${"
+	// with no closing brace. By default they're dropped from the output.
+	OnBadSyntax SyntaxPolicy
+
+	// ExpandDepth is how many times to expand references found in the
+	// values of variables (so that if A is "${B}", ${A} is B's value).
+	// By default values are used as they are. A variable that refers
+	// back to itself, directly or not, is an error.
+	ExpandDepth int
+
+	// Escape sets how the values of references are escaped, to suit the
+	// format of the output. A reference like ${VAR@json} overrides it.
+	Escape Escaping
+
+	// SkipLiterals leaves references inside of template comments and
+	// raw (backquoted) strings alone, so that eg the shell script in
+	// {{ sh `echo ${HOME}` }} is run as it's written.
+	SkipLiterals bool
+
+	// Resolvers are the schemes, by name, that references may use, as in
+	// ${file:/path} (see resolver.go). There are none by default, so that
+	// (with SystemFilters off, too) expanding untrusted input can't read
+	// files or run commands; use DefaultResolvers for the registered ones.
+	Resolvers map[string]Resolver
+
+	// SystemFilters allows the filters that run commands, read files, or
+	// look at the environment or the network, as in ${CMD|sh} (see
+	// pipeline.go). They're off by default, for the same reason.
+	SystemFilters bool
+
+	src       string   // the input to the current call to Expand
+	srcAt     int      // when streaming, the offset of src in the input...
+	srcLine   int      // ... and the number of lines before it...
+	srcCol    int      // ... and the number of characters before it on its line
+	lead      string   // when streaming, the end of the output so far
+	chain     []string // the variables whose values are being expanded
+	nesting   int      // how many expansions deep we are
+	region    bool     // when streaming, whether the input so far ends in a noexpand region
+	inAction  int      // when streaming, how much of a template action the next part starts with...
+	inQuote   byte     // ... and the quote of the string in it that it starts in, if any
+	srcmap    *SourceMap
+	assigned  map[string]string
+	undefined []Undefined
+	malformed []BadSyntax
+}
+
+// SyntaxPolicy says what an Expander does with malformed references.
+type SyntaxPolicy int
+
+// The SyntaxPolicy options.
+const (
+	EatBadSyntax    SyntaxPolicy = iota // drop them from the output
+	KeepBadSyntax                       // leave them in the output as is
+	RejectBadSyntax                     // fail, with a *SyntaxError
+)
+
+// ParseSyntaxPolicy returns the SyntaxPolicy named "eat", "keep" or
+// "error".
+func ParseSyntaxPolicy(name string) (SyntaxPolicy, error) {
+	switch name {
+	case "eat":
+		return EatBadSyntax, nil
+	case "keep":
+		return KeepBadSyntax, nil
+	case "error":
+		return RejectBadSyntax, nil
+	}
+	return EatBadSyntax, fmt.Errorf("invalid syntax policy %q: must be error, keep or eat", name)
+}
+
+// NewExpander returns an Expander that resolves variables with lookup.
+func NewExpander(lookup func(string) (string, bool)) *Expander {
+	return &Expander{Lookup: lookup}
+}
 
 // Expand replaces ${var} in the string based on the mapping function.
 // For example, Expand(s, os.Getenv) is (mostly) equivalent to
-// os.ExpandEnv(s).
+// os.ExpandEnv(s). Since mapping can't tell us otherwise, variables
+// that map to the empty string are treated as unset, and if a
+// ${VAR:?word} reference fails the input is returned unchanged.
 func Expand(s string, mapping func(string) string) string {
+	e := NewExpander(func(name string) (string, bool) {
+		val := mapping(name)
+		return val, val != ""
+	})
+	out, err := e.Expand(s)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+// Expand replaces ${var} in the string, returning an error if any
+// ${VAR:?word} reference fails (or in Strict mode, if any variables are
+// undefined, or with RejectBadSyntax, if any references are malformed).
+func (e *Expander) Expand(s string) (string, error) {
+	e.reset()
+	e.src = s
+	out, err := e.expand(s, 0)
+	if err != nil {
+		return "", err
+	}
+	if err := e.collected(); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// reset clears what's left over from any previous expansion (other than
+// the values assigned by it).
+func (e *Expander) reset() {
+	e.src, e.srcAt, e.srcLine, e.srcCol, e.lead = "", 0, 0, 0, ""
+	e.chain, e.undefined, e.malformed = nil, nil, nil
+	e.region, e.inAction, e.inQuote = false, 0, 0
+}
+
+// collected returns the errors collected during an expansion, if any.
+func (e *Expander) collected() error {
+	if len(e.malformed) > 0 {
+		return &SyntaxError{Refs: e.malformed}
+	}
+	if len(e.undefined) > 0 {
+		return &UndefinedError{Refs: e.undefined}
+	}
+	return nil
+}
+
+// expand does the work of Expand for s, which begins at offset base of
+// the original input (or if s is the value of a variable, which came
+// from the reference at base).
+func (e *Expander) expand(s string, base int) (string, error) {
+	out, _, err := e.expandPart(s, base, false)
+	return out, err
+}
+
+// expandPart expands s as expand does, unless partial is set and s ends
+// partway through a reference; then it expands only what comes before
+// the reference, returning how much of s that is.
+func (e *Expander) expandPart(s string, base int, partial bool) (string, int, error) {
+	// Only the input itself is mapped and escaped, not the operands and
+	// values expanded along the way.
+	top := e.nesting == 0
+	e.nesting++
+	defer func() { e.nesting-- }()
+
 	var buf []byte
-	// ${} is all ASCII, so bytes are fine for this operation.
 	i := 0
-	for j := 0; j < len(s); j++ {
-		if j+1 < len(s) && s[j:j+2] == "${" {
-			if buf == nil {
-				buf = make([]byte, 0, 2*len(s))
+	n, err := e.scan(s, partial, func(start, end int, ref *reference) error {
+		if buf == nil {
+			buf = make([]byte, 0, 2*len(s))
+		}
+		buf = append(buf, s[i:start]...)
+		i = end
+		out := len(buf)
+		switch {
+		case ref.literal != "":
+			// Escaped; write out what it stands for.
+			buf = append(buf, ref.literal...)
+		case ref.name == "":
+			// Encountered invalid syntax; by default, eat the
+			// characters.
+			switch e.OnBadSyntax {
+			case KeepBadSyntax:
+				buf = append(buf, s[start:end]...)
+			case RejectBadSyntax:
+				e.badSyntax(ref.bad, s[start:], end-start, e.offset(base, start))
+			}
+		default:
+			if ref.nested {
+				name, err := e.expand(ref.name, e.offset(base, start+ref.nameAt))
+				if err != nil {
+					return err
+				}
+				if !isName(name) {
+					return fmt.Errorf("%s: %q: invalid variable name", s[start:end], name)
+				}
+				ref.name = name
+			}
+			if !e.allows(ref.name) {
+				// Not ours; pass it through untouched.
+				buf = append(buf, s[start:end]...)
+				break
+			}
+			val, err := e.eval(*ref, s[start:end], e.offset(base, start))
+			if err != nil {
+				return err
+			}
+			if esc := e.escaping(ref); top && esc != EscapeNone || ref.op == "@" {
+				if val, err = esc.escape(val, e.before(buf), lineAfter(s[end:])); err != nil {
+					return fmt.Errorf("%s: %s", s[start:end], err)
+				}
+			}
+			buf = append(buf, val...)
+		}
+		if top && e.srcmap != nil {
+			e.srcmap.edits = append(e.srcmap.edits, edit{base + start, out, end - start, len(buf) - out})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	if buf == nil {
+		return s[:n], n, nil
+	}
+	return string(buf) + s[i:n], n, nil
+}
+
+// walk scans s for references, calling visit with the bounds of each
+// one. A reference with a literal is an escape, to be replaced by it,
+// and one with no name is invalid syntax. Scanning stops at the first
+// error.
+func (e *Expander) walk(s string, visit func(start, end int, ref *reference) error) error {
+	_, err := e.scan(s, false, visit)
+	return err
+}
+
+// scan does the work of walk. If partial is set, s may be cut off before
+// the end of the input, so scanning stops short at anything (like an
+// unclosed reference) that the rest of the input might change the
+// meaning of. It returns how much of s was scanned.
+func (e *Expander) scan(s string, partial bool, visit func(start, end int, ref *reference) error) (int, error) {
+	syn := e.syntax()
+	// The delimiters are all ASCII, so bytes are fine for this operation.
+	action := 0    // the end of the template action we're in, if any
+	var quote byte // the quote of the string in that action we're in, if any
+	if e.inAction > 0 {
+		// The last part of the input ended in a template action.
+		action, quote = e.inAction, e.inQuote
+		e.inAction, e.inQuote = 0, 0
+	}
+	j := 0
+	if e.region {
+		// The last part of the input ended in a noexpand region.
+		e.region = false
+		end, err := e.skipRegion(s, 0, 0, partial, visit)
+		if err != nil || e.region {
+			return end, err
+		}
+		j = end
+	}
+	for ; j < len(s); j++ {
+		if partial && e.unfinished(s[j:], j >= action) {
+			if j < action {
+				e.inAction, e.inQuote = action-j, quote
+			}
+			return j, nil
+		}
+		if j >= action && strings.HasPrefix(s[j:], "{{") {
+			if text, w, ok := comment(s[j:]); ok && text == noexpandMarker {
+				end, err := e.skipRegion(s, j, j+w, partial, visit)
+				if err != nil || e.region {
+					return end, err
+				}
+				j = end - 1
+				continue
+			} else if ok && e.SkipLiterals {
+				j += w - 1
+				continue
+			}
+			if e.Bare || e.SkipLiterals {
+				action, quote = j+actionLength(s[j:]), 0
 			}
-			if j-1 >= 0 && s[j-1] == '$' {
-				buf = append(buf, s[i:j]...)
+		}
+		if e.SkipLiterals && j < action {
+			// Leave raw strings alone, but not "..." or '...' ones.
+			switch c := s[j]; {
+			case quote != 0 && c == '\\' && j+1 < len(s) && (s[j+1] == quote || s[j+1] == '\\'):
 				j++
-				i = j
 				continue
+			case quote != 0 && c == quote:
+				quote = 0
+			case quote == 0 && (c == '"' || c == '\''):
+				quote = c
+			case quote == 0 && c == '`':
+				if end := strings.IndexByte(s[j+1:action], '`'); end >= 0 {
+					j += end + 1
+				} else {
+					j = action - 1
+				}
+				continue
+			}
+		}
+		bare := e.Bare && j >= action && s[j] == '$'
+		switch {
+		case strings.HasPrefix(s[j:], syn.Escape):
+			// Escaped; pass the opening delimiter through.
+			ref := reference{literal: syn.Open}
+			if err := visit(j, j+len(syn.Escape), &ref); err != nil {
+				return 0, err
 			}
-			buf = append(buf, s[i:j]...)
+			j += len(syn.Escape) - 1
+		case bare && j+2 < len(s) && s[j+1] == '$' && isNameStart(s[j+2]):
+			// Escaped; drop the first "$" and pass the rest through.
+			if err := visit(j, j+2, &reference{literal: "$"}); err != nil {
+				return 0, err
+			}
+			j++
+		case strings.HasPrefix(s[j:], syn.Open):
+			ref, w := syn.reference(s[j:], e.Resolvers)
+			if ref.bad != "" && !syn.nests() {
+				// Without nesting, "@" is as likely to be text as it
+				// is to open a reference, so leave anything that isn't
+				// valid alone.
+				continue
+			}
+			if err := visit(j, j+w, &ref); err != nil {
+				return 0, err
+			}
+			j += w - 1
+		case bare:
 			name, w := getShellName(s[j+1:])
-			if name == "" && w > 0 {
-				// Encountered invalid syntax; eat the
-				// characters.
-			} else {
-				buf = append(buf, mapping(name)...)
+			if name == "" || name == "$" {
+				continue
+			}
+			if err := visit(j, j+1+w, &reference{name: name, bare: true}); err != nil {
+				return 0, err
 			}
 			j += w
-			i = j + 1
 		}
 	}
-	if buf == nil {
+	if action > len(s) {
+		e.inAction, e.inQuote = action-len(s), quote
+	}
+	return len(s), nil
+}
+
+// skipRegion visits the noexpand region that begins at s[i] as it is,
+// looking for the marker that ends it from s[from] on, and returns where
+// the region ends. If partial is set and the region hasn't ended by the
+// end of s, it stops short of anything that could be the start of the
+// marker, and e.region is set so that the next part of the input starts
+// out in the region.
+func (e *Expander) skipRegion(s string, i, from int, partial bool, visit func(start, end int, ref *reference) error) (int, error) {
+	end := regionEnd(s[from:])
+	switch {
+	case end >= 0:
+		end += from
+	case partial:
+		end = from + regionCut(s[from:])
+		e.region = true
+	default:
+		end = len(s)
+	}
+	if end > i {
+		if err := visit(i, end, &reference{literal: s[i:end]}); err != nil {
+			return 0, err
+		}
+	}
+	return end, nil
+}
+
+// syntax returns the Syntax in use.
+func (e *Expander) syntax() Syntax {
+	if e.Syntax == (Syntax{}) {
+		return DefaultSyntax
+	}
+	return e.Syntax
+}
+
+// offset returns the offset in the original input of s[i], where s
+// begins at base. Within the value of a variable, that's base: the
+// reference the value came from.
+func (e *Expander) offset(base, i int) int {
+	if len(e.chain) > 0 {
+		return base
+	}
+	return base + i
+}
+
+// badSyntax records the malformed reference that takes up the first n
+// bytes of s, found at offset start of the original input.
+func (e *Expander) badSyntax(reason, s string, n, start int) {
+	offset, line, col := e.position(start)
+	e.malformed = append(e.malformed, BadSyntax{
+		Offset:  offset,
+		Line:    line,
+		Column:  col,
+		Snippet: snippet(s, n),
+		Reason:  reason,
+	})
+}
+
+// position returns the offset, line and column in the whole input of
+// the given offset of src.
+func (e *Expander) position(offset int) (int, int, int) {
+	line, col := position(e.src, offset)
+	if line == 1 {
+		col += e.srcCol
+	}
+	return e.srcAt + offset, e.srcLine + line, col
+}
+
+// escaping returns the Escaping to use for the reference.
+func (e *Expander) escaping(ref *reference) Escaping {
+	if ref.op == "@" {
+		return escapings[ref.word]
+	}
+	return e.Escape
+}
+
+// before returns the end of the output before a reference, where buf is
+// the output of the current expansion so far.
+func (e *Expander) before(buf []byte) string {
+	if len(buf) >= maxContext {
+		return string(buf[len(buf)-maxContext:])
+	}
+	before := e.lead + string(buf)
+	if len(before) > maxContext {
+		before = before[len(before)-maxContext:]
+	}
+	return before
+}
+
+// lineAfter returns the rest of the line at the start of s.
+func lineAfter(s string) string {
+	if len(s) > maxContext {
+		s = s[:maxContext]
+	}
+	if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+		return s[:nl]
+	}
+	return s
+}
+
+// allows reports whether the named variable may be expanded.
+func (e *Expander) allows(name string) bool {
+	return e.Allow == nil || e.Allow(name)
+}
+
+// lookup checks for values assigned during this expansion before
+// falling back to the Lookup function.
+func (e *Expander) lookup(name string) (string, bool) {
+	if val, ok := e.assigned[name]; ok {
+		return val, true
+	}
+	if e.Lookup == nil {
+		return "", false
+	}
+	return e.Lookup(name)
+}
+
+// eval resolves a single parsed reference, written as text at offset
+// start of the original input, applying its operator and then any
+// filters.
+func (e *Expander) eval(ref reference, text string, start int) (string, error) {
+	for _, cmd := range ref.pipeline {
+		if systemFilters[cmd.name] && !e.SystemFilters {
+			return "", fmt.Errorf("%s: filter %q isn't allowed", text, cmd.name)
+		}
+	}
+	val, err := e.value(ref, text, start)
+	if err != nil || ref.pipeline == nil {
+		return val, err
+	}
+	if val, err = runPipeline(ref.pipeline, val); err != nil {
+		return "", fmt.Errorf("%s: %s", text, err)
+	}
+	return val, nil
+}
+
+// value does the work of eval, up until the filters.
+func (e *Expander) value(ref reference, text string, start int) (string, error) {
+	if ref.scheme != "" {
+		arg, err := e.expand(ref.word, e.offset(start, ref.wordAt))
+		if err != nil {
+			return "", err
+		}
+		r := e.Resolvers[ref.scheme]
+		if r == nil {
+			return "", fmt.Errorf("%s: scheme %q isn't allowed here", text, ref.scheme)
+		}
+		val, err := r.Resolve(arg)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", text, err)
+		}
+		return val, nil
+	}
+	val, set := e.lookup(ref.name)
+	if ref.indirect {
+		// ${!REF}: if REF is set, it names the variable we want.
+		e.checkDefined(ref, val, set, text, start)
+		if !set || val == "" {
+			return e.apply(ref, "", false, start)
+		}
+		if !isName(val) {
+			return "", fmt.Errorf("%s: %q: invalid variable name", text, val)
+		}
+		ref.name = val
+		val, set = e.lookup(ref.name)
+	}
+	e.checkDefined(ref, val, set, text, start)
+	if set && e.ExpandDepth > 0 {
+		var err error
+		if val, err = e.recurse(ref.name, val, start); err != nil {
+			return "", err
+		}
+	}
+	return e.apply(ref, val, set, start)
+}
+
+// apply applies the reference's operator to val, the value of the
+// variable (if it's set).
+func (e *Expander) apply(ref reference, val string, set bool, start int) (string, error) {
+	if ref.length {
+		return strconv.Itoa(utf8.RuneCountInString(val)), nil
+	}
+	if ref.op == "" {
+		return val, nil
+	}
+	if isStringOp(ref.op) {
+		return e.evalStringOp(ref, val, start)
+	}
+
+	// With the colon, an empty value counts as missing too.
+	missing := !set || (ref.op[0] == ':' && val == "")
+
+	switch ref.op[len(ref.op)-1] {
+	case '-':
+		if missing {
+			return e.expand(ref.word, e.offset(start, ref.wordAt))
+		}
+	case '=':
+		if missing {
+			word, err := e.expand(ref.word, e.offset(start, ref.wordAt))
+			if err != nil {
+				return "", err
+			}
+			if e.assigned == nil {
+				e.assigned = make(map[string]string)
+			}
+			e.assigned[ref.name] = word
+			return word, nil
+		}
+	case '+':
+		if missing {
+			return "", nil
+		}
+		return e.expand(ref.word, e.offset(start, ref.wordAt))
+	case '?':
+		if missing {
+			msg, err := e.expand(ref.word, e.offset(start, ref.wordAt))
+			if err != nil {
+				return "", err
+			}
+			if msg == "" && ref.op[0] == ':' {
+				msg = "parameter null or not set"
+			} else if msg == "" {
+				msg = "parameter not set"
+			}
+			return "", fmt.Errorf("${%s}: %s", ref.name, msg)
+		}
+	}
+	return val, nil
+}
+
+// checkDefined records, in Strict mode, a reference to a variable that
+// isn't set, or is empty without AllowEmpty (unless its operator allows
+// for that).
+func (e *Expander) checkDefined(ref reference, val string, set bool, text string, start int) {
+	if e.Strict && !isParamOp(ref.op) && (!set || (val == "" && !e.AllowEmpty)) {
+		_, line, col := e.position(start)
+		e.undefined = append(e.undefined, Undefined{
+			Name:   ref.name,
+			Text:   text,
+			Line:   line,
+			Column: col,
+			Empty:  set,
+		})
+	}
+}
+
+// recurse expands the references in val, the value of the named
+// variable, until ExpandDepth is reached.
+func (e *Expander) recurse(name, val string, start int) (string, error) {
+	for i, n := range e.chain {
+		if n == name {
+			chain := append(e.chain[i:len(e.chain):len(e.chain)], name)
+			return "", fmt.Errorf("reference cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if len(e.chain) >= e.ExpandDepth {
+		return val, nil
+	}
+	e.chain = append(e.chain, name)
+	defer func() { e.chain = e.chain[:len(e.chain)-1] }()
+	return e.expand(val, start)
+}
+
+// evalStringOp applies one of the pattern, substring or case operators
+// to val.
+func (e *Expander) evalStringOp(ref reference, val string, start int) (string, error) {
+	word, err := e.expand(ref.word, e.offset(start, ref.wordAt))
+	if err != nil {
+		return "", err
+	}
+	arg, err := e.expand(ref.arg, e.offset(start, ref.argAt))
+	if err != nil {
+		return "", err
+	}
+
+	switch ref.op {
+	case "#", "##":
+		return trimGlobPrefix(val, word, ref.op == "##"), nil
+	case "%", "%%":
+		return trimGlobSuffix(val, word, ref.op == "%%"), nil
+	case "/", "//":
+		return replaceGlob(val, word, unescape(arg), ref.op == "//", 0), nil
+	case "/#", "/%":
+		return replaceGlob(val, word, unescape(arg), false, ref.op[1]), nil
+	case "^", "^^":
+		return convertCase(val, word, true, ref.op == "^^"), nil
+	case ",", ",,":
+		return convertCase(val, word, false, ref.op == ",,"), nil
+	case "@":
+		return val, nil // escaped by expandPart
+	}
+
+	// Otherwise it's ${VAR:offset} or ${VAR:offset:length}.
+	runes := []rune(val)
+	offset, err := parseOffset(word)
+	if err != nil {
+		return "", fmt.Errorf("${%s}: %s", ref.name, err)
+	}
+	if offset < 0 {
+		offset += len(runes)
+	}
+	if offset < 0 || offset > len(runes) {
+		return "", nil
+	}
+	end := len(runes)
+	if ref.hasArg {
+		length, err := parseOffset(arg)
+		if err != nil {
+			return "", fmt.Errorf("${%s}: %s", ref.name, err)
+		}
+		if length < 0 {
+			end += length
+			if end < offset {
+				return "", fmt.Errorf("${%s}: %d: substring expression < 0", ref.name, length)
+			}
+		} else if offset+length < end {
+			end = offset + length
+		}
+	}
+	return string(runes[offset:end]), nil
+}
+
+// parseOffset parses the integer operands of ${VAR:offset:length}, which
+// may be padded with spaces or wrapped in parentheses (so that negative
+// offsets can be told apart from ${VAR:-word}).
+func parseOffset(s string) (int, error) {
+	str := strings.TrimSpace(s)
+	if len(str) >= 2 && str[0] == '(' && str[len(str)-1] == ')' {
+		str = strings.TrimSpace(str[1 : len(str)-1])
+	}
+	if str == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("%q: invalid offset", s)
+	}
+	return n, nil
+}
+
+// unescape removes the backslashes quoting characters in a replacement
+// string, so that ${VAR/a/\/} replaces "a" with "/".
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
 		return s
 	}
-	return string(buf) + s[i:]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// reference is a single parsed ${...} expression.
+type reference struct {
+	name     string // the variable name
+	op       string // the operator, eg ":-" or "##", or "" for none
+	word     string // the (unexpanded) operand of op
+	arg      string // the (unexpanded) replacement or substring length
+	hasArg   bool   // whether a substring length was given at all
+	length   bool   // whether this is ${#VAR}
+	bare     bool   // whether this is $VAR
+	indirect bool   // whether this is ${!VAR}
+	nested   bool   // whether the name contains references, eg ${A_${B}}
+	nameAt   int    // the offset of name from the start of the reference
+	wordAt   int    // the offset of word from the start of the reference
+	argAt    int    // the offset of arg from the start of the reference
+	bad      string // why the reference is invalid, if it is
+	literal  string // for escapes, the text to write in their place
+	scheme   string // for ${scheme:arg}, the scheme (and word is arg)
+	pipeline []pipeCmd
+}
+
+// paramOps are the parameter operators, longest first so that ":-" is
+// matched before "-".
+var paramOps = []string{":-", ":=", ":+", ":?", "-", "=", "+", "?"}
+
+// stringOps are the string operators, again longest first. They're
+// checked after paramOps, so that ${VAR:-1} is a default rather than
+// a substring.
+var stringOps = []string{"##", "#", "%%", "%", "//", "/#", "/%", "/", ":", "^^", "^", ",,", ",", "@"}
+
+// isParamOp reports whether op is one of paramOps.
+func isParamOp(op string) bool {
+	for _, pop := range paramOps {
+		if op == pop {
+			return true
+		}
+	}
+	return false
+}
+
+// isStringOp reports whether op is one of stringOps.
+func isStringOp(op string) bool {
+	for _, sop := range stringOps {
+		if op == sop {
+			return true
+		}
+	}
+	return false
 }
 
 // isShellSpecialVar reports whether the character identifies a special
@@ -57,27 +845,226 @@ func isShellSpecialVar(c uint8) bool {
 	return false
 }
 
+// isNameStart reports whether the byte can start a variable name.
+func isNameStart(c uint8) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
 // isAlphaNum reports whether the byte is an ASCII letter, number, or underscore
 func isAlphaNum(c uint8) bool {
 	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
 }
 
-// getShellName returns the name that begins the string and the number of bytes
-// consumed to extract it. Since the name is enclosed in {}, it's part of a ${}
-// expansion and two more bytes are needed than the length of the name. If the
-// internal syntax is un-env-iable (get it?), then just "eat" the variable.
+// getShellName returns the name that begins the string and the number of
+// bytes consumed to extract it: either a run of letters, numbers and
+// underscores, or a single special variable character.
 func getShellName(s string) (string, int) {
-	if len(s) > 2 && isShellSpecialVar(s[1]) && s[2] == '}' {
-		return s[1:2], 3
+	i := 0
+	for i < len(s) && isAlphaNum(s[i]) {
+		i++
+	}
+	if i == 0 && len(s) > 0 && isShellSpecialVar(s[0]) {
+		return s[:1], 1
+	}
+	return s[:i], i
+}
+
+// isName reports whether s is a valid variable name (not counting the
+// special variables).
+func isName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isAlphaNum(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// reference parses the reference that begins the string (which must
+// start with syn.Open), returning it and the number of bytes consumed.
+// If the internal syntax is un-env-iable (get it?), then the name is
+// empty, bad says why, and the caller should (by default) just "eat"
+// the consumed bytes. Only the schemes in resolvers are taken as such.
+func (syn Syntax) reference(s string, resolvers map[string]Resolver) (reference, int) {
+	open := len(syn.Open)
+	end := syn.closing(s, open)
+	if end < 0 {
+		return reference{bad: "unterminated reference"}, open // Bad syntax; eat "${"
+	}
+	width := end + len(syn.Close)
+
+	body := s[open:end]
+	ref := reference{nameAt: open}
+
+	// A pipeline of filters may follow, as in ${NAME|lower}.
+	if before, filters, ok := syn.splitPipeline(body); ok {
+		pipeline, err := parsePipeline(filters)
+		if err != nil {
+			return reference{bad: err.Error()}, width // Bad syntax; eat "${VAR|...}"
+		}
+		body, ref.pipeline = strings.TrimRight(before, " "), pipeline
+	}
+	body = strings.ReplaceAll(body, `\|`, "|")
+
+	// ${env:NAME} is just ${NAME}, and any other scheme, as in
+	// ${file:/path}, takes the rest as its argument.
+	if strings.HasPrefix(body, "env:") && len(body) > 4 && isNameStart(body[4]) {
+		open += 4
+		body, ref.nameAt = body[4:], open
+	} else if scheme, arg, ok := splitScheme(body, resolvers); ok {
+		ref.name, ref.scheme, ref.word, ref.wordAt = body, scheme, arg, open+len(scheme)+1
+		return ref, width
+	}
+
+	switch {
+	case len(body) > 1 && body[0] == '#':
+		// ${#VAR} is the length of VAR, but ${#} is the special variable.
+		if name, w, nested := syn.name(body[1:]); name != "" && w == len(body)-1 {
+			ref.name, ref.length, ref.nested, ref.nameAt = name, true, nested, open+1
+			return ref, width
+		}
+	case len(body) > 1 && body[0] == '!':
+		// Likewise ${!VAR} is indirect, but ${!} is the special variable.
+		if name, _, _ := syn.name(body[1:]); name != "" {
+			ref.indirect = true
+			ref.nameAt++
+		}
+	}
+
+	name, w, nested := syn.name(body[ref.nameAt-open:])
+	if name == "" {
+		name, w = getShellName(body)
+	}
+	if body == "" {
+		return reference{bad: "empty name"}, width // Bad syntax; eat "${}"
+	}
+	if name == "" {
+		return reference{bad: fmt.Sprintf("invalid name %q", body)}, width // Bad syntax; eat "${...}"
+	}
+	if nested && ref.indirect {
+		return reference{bad: "nested indirect reference"}, width // Bad syntax; eat "${!A_${B}}"
+	}
+	ref.name, ref.nested = name, nested
+	rest := body[ref.nameAt-open+w:]
+	if rest == "" {
+		return ref, width
+	}
+	for _, op := range paramOps {
+		if strings.HasPrefix(rest, op) {
+			ref.op = op
+			ref.word = rest[len(op):]
+			ref.wordAt = ref.nameAt + w + len(op)
+			return ref, width
+		}
 	}
-	// Scan to closing brace
-	for i := 1; i < len(s); i++ {
-		if s[i] == '}' {
-			if i == 1 {
-				return "", 2 // Bad syntax; eat "${}"
+	for _, op := range stringOps {
+		if strings.HasPrefix(rest, op) {
+			ref.op = op
+			ref.word = rest[len(op):]
+			ref.wordAt = ref.nameAt + w + len(op)
+			switch op[0] {
+			case '/':
+				ref.word, ref.arg, _ = syn.splitOperand(ref.word, '/')
+			case ':':
+				if ref.word == "" {
+					return reference{bad: "missing substring offset"}, width // Bad syntax; eat "${VAR:}"
+				}
+				ref.word, ref.arg, ref.hasArg = syn.splitOperand(ref.word, ':')
+			case '@':
+				if ref.word == "Q" {
+					ref.word = "shell" // as in bash
+				}
+				if _, err := ParseEscaping(ref.word); err != nil {
+					return reference{bad: err.Error()}, width // Bad syntax; eat "${VAR@...}"
+				}
 			}
-			return s[1:i], i + 1
+			ref.argAt = ref.wordAt + len(ref.word) + 1
+			return ref, width
+		}
+	}
+	return reference{bad: fmt.Sprintf("invalid operator %q", rest)}, width // Bad syntax; eat "${...}"
+}
+
+// name returns the name that begins the string, the number of bytes it
+// takes up, and whether it's nested: that is, made up of references as
+// well as letters, numbers and underscores, like DB_${ENV}_HOST. Unlike
+// getShellName it doesn't return the special variables.
+func (syn Syntax) name(s string) (string, int, bool) {
+	i, nested := 0, false
+	for i < len(s) {
+		if isAlphaNum(s[i]) {
+			i++
+			continue
+		}
+		if !syn.nests() || !strings.HasPrefix(s[i:], syn.Open) {
+			break
+		}
+		end := syn.closing(s, i+len(syn.Open))
+		if end < 0 {
+			break
+		}
+		i, nested = end+len(syn.Close), true
+	}
+	return s[:i], i, nested
+}
+
+// splitOperand splits s around the first sep that isn't escaped with a
+// backslash or inside of a nested ${...} reference.
+func (syn Syntax) splitOperand(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case syn.nests() && strings.HasPrefix(s[i:], syn.Open):
+			if end := syn.closing(s, i+len(syn.Open)); end >= 0 {
+				i = end + len(syn.Close) - 1
+			}
+		case s[i] == sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// splitPipeline splits s around the first "|" that's followed by the
+// name of a filter (and isn't escaped or inside of a nested reference),
+// so that any other "|" is left alone, as in ${VAR//\//|}.
+func (syn Syntax) splitPipeline(s string) (string, string, bool) {
+	for i := 0; i < len(s); {
+		before, after, ok := syn.splitOperand(s[i:], '|')
+		if !ok {
+			break
+		}
+		if startsFilter(after) {
+			return s[:i+len(before)], after, true
+		}
+		i += len(before) + 1
+	}
+	return s, "", false
+}
+
+// closing returns the index of the syn.Close closing the reference that
+// s[i:] is inside of, accounting for any nested ${...} references along
+// the way, or -1 if there isn't one.
+func (syn Syntax) closing(s string, i int) int {
+	if !syn.nests() {
+		if end := strings.Index(s[i:], syn.Close); end >= 0 {
+			return i + end
+		}
+		return -1
+	}
+	depth := 0
+	for ; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], syn.Open):
+			depth++
+			i += len(syn.Open) - 1
+		case strings.HasPrefix(s[i:], syn.Close) && depth == 0:
+			return i
+		case strings.HasPrefix(s[i:], syn.Close):
+			depth--
+			i += len(syn.Close) - 1
 		}
 	}
-	return "", 1 // Bad syntax; eat "${"
+	return -1
 }
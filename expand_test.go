@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"reflect"
 	"testing"
 
 	gosubst "github.com/hews/gosubst"
@@ -58,7 +59,21 @@ var expandTests = []struct {
 	{"Hello {{ printf \"$HOME\" }}", "Hello {{ printf \"$HOME\" }}"},
 	{"Hello {{ printf \"$$HOME\" }}", "Hello {{ printf \"$$HOME\" }}"},
 	{"Hello {{ printf \"$${HOME}\" }}", "Hello {{ printf \"${HOME}\" }}"},
+	{"${HOME:-/tmp}", "/usr/gopher"},
+	{"${NOPE:-/tmp}", "/tmp"},
+	{"${NOPE-/tmp}", "/tmp"},
+	{"${NOPE:-${HOME}/bin}", "/usr/gopher/bin"},
+	{"${NOPE:-$${HOME}}", "${HOME}"},
+	{"${NOPE:-{x}}", "{x}"},
+	{"${HOME:+set}", "set"},
+	{"${NOPE:+set}", ""},
+	{"${NOPE:=assigned} ${NOPE}", "assigned assigned"},
+	{"${1:-one}", "ARGUMENT1"},
+	{"${NOPE:?}", "${NOPE:?}"},
 	// invalid syntax; eat up the characters
+	{"${HOME:}", ""},
+	{"${HOME bar}", ""},
+	{"${A ${H}", "A (Value of H)"},
 	{"${", ""},
 	{"${}", ""},
 	{"start${+middle}${^end}$", "start$"},
@@ -73,3 +88,397 @@ func TestExpand(t *testing.T) {
 		}
 	}
 }
+
+func testLookupEnv(s string) (string, bool) {
+	switch s {
+	case "EMPTY":
+		return "", true
+	case "FULL":
+		return "full", true
+	}
+	return "", false
+}
+
+var expanderTests = []struct {
+	in, out string
+	err     string
+}{
+	{"${EMPTY:-default}", "default", ""},
+	{"${EMPTY-default}", "", ""},
+	{"${UNSET-default}", "default", ""},
+	{"${FULL-default}", "full", ""},
+	{"${EMPTY:=x}${EMPTY}", "xx", ""},
+	{"${EMPTY=x}${EMPTY}", "", ""},
+	{"${UNSET=x}${UNSET}", "xx", ""},
+	{"${EMPTY:+alt}", "", ""},
+	{"${EMPTY+alt}", "alt", ""},
+	{"${FULL:+${FULL}-alt}", "full-alt", ""},
+	{"${UNSET+alt}", "", ""},
+	{"${FULL:?oops}", "full", ""},
+	{"${EMPTY?oops}", "", ""},
+	{"${EMPTY:?oops}", "", "${EMPTY}: oops"},
+	{"${UNSET?}", "", "${UNSET}: parameter not set"},
+	{"${UNSET:?}", "", "${UNSET}: parameter null or not set"},
+	{"${UNSET:?${FULL} is missing}", "", "${UNSET}: full is missing"},
+	{"${FULL:-${UNSET:?nested}}", "full", ""},
+	{"${EMPTY:-${UNSET:?nested}}", "", "${UNSET}: nested"},
+}
+
+func TestExpander(t *testing.T) {
+	for _, test := range expanderTests {
+		result, err := gosubst.NewExpander(testLookupEnv).Expand(test.in)
+		if test.err == "" && err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("Expander.Expand(%q) has error %v; expected %q", test.in, err, test.err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+	}
+}
+
+func testImageEnv(s string) (string, bool) {
+	switch s {
+	case "IMG":
+		return "docker.io/library/nginx:latest", true
+	case "PFX":
+		return "docker.io/", true
+	case "APP":
+		return "My-App_Name", true
+	case "LOW":
+		return "hello world", true
+	case "EMPTY":
+		return "", true
+	}
+	return "", false
+}
+
+// Expected values were checked against bash 5.
+var stringOpTests = []struct {
+	in, out string
+}{
+	{"${IMG#*/}", "library/nginx:latest"},
+	{"${IMG##*/}", "nginx:latest"},
+	{"${IMG%:*}", "docker.io/library/nginx"},
+	{"${IMG%%:*}", "docker.io/library/nginx"},
+	{"${IMG/nginx/apache}", "docker.io/library/apache:latest"},
+	{"${IMG//o/0}", "d0cker.i0/library/nginx:latest"},
+	{"${IMG/#docker.io\\//}", "library/nginx:latest"},
+	{"${IMG/%latest/stable}", "docker.io/library/nginx:stable"},
+	{"${IMG/*\\//}", "nginx:latest"},
+	{"${IMG:0:9}", "docker.io"},
+	{"${IMG:10}", "library/nginx:latest"},
+	{"${IMG: -6}", "latest"},
+	{"${IMG:(-6):3}", "lat"},
+	{"${IMG:2:-3}", "cker.io/library/nginx:lat"},
+	{"${#IMG}", "30"},
+	{"${IMG#${PFX}}", "library/nginx:latest"},
+	{"${IMG/o}", "dcker.io/library/nginx:latest"},
+	{"${IMG//\\//|}", "docker.io|library|nginx:latest"},
+	{"${IMG:100}", ""},
+	{"${IMG/#/pre-}", "pre-docker.io/library/nginx:latest"},
+	{"${IMG/%/-post}", "docker.io/library/nginx:latest-post"},
+	{"${IMG%%[0-9]*}", "docker.io/library/nginx:latest"},
+	{"${EMPTY#*}", ""},
+	{"${#UNSET}", "0"},
+	{"${#}", ""},
+	{"${IMG:-x}", "docker.io/library/nginx:latest"},
+	{"${APP,,}", "my-app_name"},
+	{"${APP^^}", "MY-APP_NAME"},
+	{"${APP,}", "my-App_Name"},
+	{"${LOW^}", "Hello world"},
+	{"${LOW^^[lo]}", "heLLO wOrLd"},
+	{"${LOW^[lo]}", "hello world"},
+	{"${LOW^[h]}", "Hello world"},
+	{"${APP,,[A-M]}", "my-app_Name"},
+	{"${APP,[m]}", "My-App_Name"},
+	{"${UNSET^^}", ""},
+	{"${APP^^*}", "MY-APP_NAME"},
+	{"${APP,,?}-deployment", "my-app_name-deployment"},
+}
+
+func TestExpanderStringOps(t *testing.T) {
+	for _, test := range stringOpTests {
+		result, err := gosubst.NewExpander(testImageEnv).Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+	}
+
+	for _, in := range []string{"${IMG:x}", "${IMG:2:-100}"} {
+		if _, err := gosubst.NewExpander(testImageEnv).Expand(in); err == nil {
+			t.Errorf("Expander.Expand(%q) has error nil; expected an error", in)
+		}
+	}
+}
+
+var bareTests = []struct {
+	in, out string
+}{
+	{"$HOME", "/usr/gopher"},
+	{"${HOME}", "/usr/gopher"},
+	{"$HOME/bin:$H", "/usr/gopher/bin:(Value of H)"},
+	{"$home_1-$1", "/usr/foo-ARGUMENT1"},
+	{"$$HOME", "$HOME"},
+	{"$${HOME}", "${HOME}"},
+	{"$$", "$$"},
+	{"$", "$"},
+	{"$}", "$}"},
+	{"cost: 5$", "cost: 5$"},
+	{"mixed$|bag$$$", "mixed$|bag$$$"},
+	{"$NOPE.", "."},
+	{"Hello {{ printf \"$HOME\" }} $HOME", "Hello {{ printf \"$HOME\" }} /usr/gopher"},
+	{"Hello {{ printf \"${HOME}\" }}", "Hello {{ printf \"/usr/gopher\" }}"},
+	{"{{ $x := \"}}\" }}{{ $x }}$H", "{{ $x := \"}}\" }}{{ $x }}(Value of H)"},
+	{"{{- range $k, $v := . -}}$H{{ end }}", "{{- range $k, $v := . -}}(Value of H){{ end }}"},
+	{"{{/* $H }} */}}$H", "{{/* $H }} */}}(Value of H)"},
+	{"{{ `$H }}` }}$H", "{{ `$H }}` }}(Value of H)"},
+	{"{{ $H", "{{ $H"},
+}
+
+func TestExpanderBare(t *testing.T) {
+	e := gosubst.NewExpander(func(s string) (string, bool) {
+		val := testGetenv(s)
+		return val, val != ""
+	})
+	e.Bare = true
+	for _, test := range bareTests {
+		result, err := e.Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+	}
+}
+
+var regionTests = []struct {
+	in, out, literals string
+}{
+	{
+		"${FULL}\n{{/* gosubst:noexpand */}}\n${FULL}\n{{/* gosubst:expand */}}\n${FULL}",
+		"full\n{{/* gosubst:noexpand */}}\n${FULL}\n{{/* gosubst:expand */}}\nfull",
+		"",
+	},
+	{
+		"{{- /* gosubst:noexpand */ -}} ${FULL} {{/* not the end */}} $${FULL}",
+		"{{- /* gosubst:noexpand */ -}} ${FULL} {{/* not the end */}} $${FULL}",
+		"",
+	},
+	{"{{/* gosubst:noexpand */ ${FULL}", "{{/* gosubst:noexpand */ full", ""},
+	{"{{/* gosubst:expand */}} ${FULL}", "{{/* gosubst:expand */}} full", ""},
+	{
+		"{{/* ${FULL} */}} {{ sh `echo ${FULL}` }} {{ \"${FULL}`\" }} {{ '`' }} ${FULL}",
+		"{{/* full */}} {{ sh `echo full` }} {{ \"full`\" }} {{ '`' }} full",
+		"{{/* ${FULL} */}} {{ sh `echo ${FULL}` }} {{ \"full`\" }} {{ '`' }} full",
+	},
+	{"{{ `${FULL}", "{{ `full", "{{ `${FULL}"},
+}
+
+func TestExpanderRegions(t *testing.T) {
+	e := gosubst.NewExpander(testLookupEnv)
+	for _, test := range regionTests {
+		for _, skip := range []bool{false, true} {
+			expected := test.out
+			if skip && test.literals != "" {
+				expected = test.literals
+			}
+			e.SkipLiterals = skip
+			result, err := e.Expand(test.in)
+			if err != nil {
+				t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+			}
+			if result != expected {
+				t.Errorf("Expander.Expand(%q) with SkipLiterals %t == %q; expected %q", test.in, skip, result, expected)
+			}
+			checkStream(t, e, test.in)
+		}
+	}
+}
+
+func testDeployEnv(s string) (string, bool) {
+	val, ok := map[string]string{
+		"DEPLOY_ENV":      "PROD",
+		"DB_PROD_HOST":    "db.prod",
+		"DB_STAGING_HOST": "db.staging",
+		"DB_VAR":          "DB_PROD_HOST",
+		"BAD_VAR":         "not a name",
+		"EMPTY":           "",
+		"URL":             "https://${DB_${DEPLOY_ENV}_HOST}:${PORT:-5432}",
+		"LINK":            "${URL}/app",
+		"PING":            "${PONG}",
+		"PONG":            "x${PING}",
+		"SELF":            "${SELF}",
+	}[s]
+	return val, ok
+}
+
+var nestedTests = []struct {
+	in, out string
+	err     string
+}{
+	{"${DB_${DEPLOY_ENV}_HOST}", "db.prod", ""},
+	{"${DB_${UNSET:-STAGING}_HOST}", "db.staging", ""},
+	{"${DB_${UNSET}_HOST:-none}", "none", ""},
+	{"${#DB_${DEPLOY_ENV}_HOST}", "7", ""},
+	{"${DB_${DEPLOY_ENV}_HOST%.*}", "db", ""},
+	{"${DB_${BAD_VAR}}", "", `${DB_${BAD_VAR}}: "DB_not a name": invalid variable name`},
+	{"${!DB_VAR}", "db.prod", ""},
+	{"${!DB_VAR^^}", "DB.PROD", ""},
+	{"${!UNSET:-default}", "default", ""},
+	{"${!EMPTY}", "", ""},
+	{"${!BAD_VAR}", "", `${!BAD_VAR}: "not a name": invalid variable name`},
+	{"${!DEPLOY_ENV-unset}", "unset", ""},
+	{"${!}${#}", "", ""},
+	{"${URL}", "https://${DB_${DEPLOY_ENV}_HOST}:${PORT:-5432}", ""},
+}
+
+func TestExpanderNested(t *testing.T) {
+	for _, test := range nestedTests {
+		result, err := gosubst.NewExpander(testDeployEnv).Expand(test.in)
+		if test.err == "" && err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("Expander.Expand(%q) has error %v; expected %q", test.in, err, test.err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+	}
+}
+
+var depthTests = []struct {
+	in    string
+	depth int
+	out   string
+	err   string
+}{
+	{"${URL}", 1, "https://db.prod:5432", ""},
+	{"${LINK}", 1, "https://${DB_${DEPLOY_ENV}_HOST}:${PORT:-5432}/app", ""},
+	{"${LINK}", 2, "https://db.prod:5432/app", ""},
+	{"${LINK%/app}", 5, "https://db.prod:5432", ""},
+	{"$${URL}", 5, "${URL}", ""},
+	{"${SELF}", 1, "", "reference cycle: SELF -> SELF"},
+	{"${PING}", 5, "", "reference cycle: PING -> PONG -> PING"},
+	{"${PING}", 1, "x${PING}", ""},
+}
+
+func TestExpanderDepth(t *testing.T) {
+	for _, test := range depthTests {
+		e := gosubst.NewExpander(testDeployEnv)
+		e.ExpandDepth = test.depth
+		result, err := e.Expand(test.in)
+		if test.err == "" && err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("Expander.Expand(%q) has error %v; expected %q", test.in, err, test.err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+	}
+
+	// Undefined variables in values are reported where the value is used.
+	e := gosubst.NewExpander(func(name string) (string, bool) {
+		if name == "A" {
+			return "${B} ${C:-c}", true
+		}
+		return "", false
+	})
+	e.Strict, e.ExpandDepth = true, 1
+	_, err := e.Expand("x\n  ${A}")
+	expected := &gosubst.UndefinedError{Refs: []gosubst.Undefined{{Name: "B", Text: "${B}", Line: 2, Column: 3}}}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expander.Expand() has error %v; expected %v", err, expected)
+	}
+}
+
+func TestExpanderStrict(t *testing.T) {
+	input := "name: ${APP_NAEM}\n" +
+		"image: ${IMG:-nginx}:${TAG}\n" +
+		"  ü: ${FULL} ${EMPTY} ${#UNSET} ${EMPTY:+x}\n" +
+		"  nested: ${FULL:+${NESTED}} ${UNSET-${DEFAULT}}"
+
+	e := gosubst.NewExpander(testLookupEnv)
+	e.Strict = true
+	_, err := e.Expand(input)
+	undefined, ok := err.(*gosubst.UndefinedError)
+	if !ok {
+		t.Fatalf("Expander.Expand() has error %v; expected an *UndefinedError", err)
+	}
+	expected := []gosubst.Undefined{
+		{Name: "APP_NAEM", Text: "${APP_NAEM}", Line: 1, Column: 7},
+		{Name: "TAG", Text: "${TAG}", Line: 2, Column: 22},
+		{Name: "EMPTY", Text: "${EMPTY}", Line: 3, Column: 14, Empty: true},
+		{Name: "UNSET", Text: "${#UNSET}", Line: 3, Column: 23},
+		{Name: "NESTED", Text: "${NESTED}", Line: 4, Column: 19},
+		{Name: "DEFAULT", Text: "${DEFAULT}", Line: 4, Column: 38},
+	}
+	if !reflect.DeepEqual(undefined.Refs, expected) {
+		t.Errorf("Expander.Expand() found undefined\n%+v\nexpected\n%+v", undefined.Refs, expected)
+	}
+
+	e.AllowEmpty = true
+	_, err = e.Expand(input)
+	if undefined, ok := err.(*gosubst.UndefinedError); !ok || len(undefined.Refs) != len(expected)-1 {
+		t.Errorf("Expander.Expand() with AllowEmpty has error %v; expected %d undefined", err, len(expected)-1)
+	}
+
+	result, err := e.Expand("${FULL} ${EMPTY}")
+	if err != nil || result != "full " {
+		t.Errorf("Expander.Expand() == %q, %v; expected %q, nil", result, err, "full ")
+	}
+}
+
+var badSyntaxTests = []struct {
+	in, eat, keep string
+}{
+	{"${", "", "${"},
+	{"${}", "", "${}"},
+	{"start${+middle}${^end}$", "start$", "start${+middle}${^end}$"},
+	{`{"a": "${FULL"}`, `{"a": "`, `{"a": "${FULL"}`},
+	{"${FULL bar} ${FULL}", " full", "${FULL bar} full"},
+	{"${FULL:}", "", "${FULL:}"},
+}
+
+func TestExpanderBadSyntax(t *testing.T) {
+	e := gosubst.NewExpander(testLookupEnv)
+	for _, test := range badSyntaxTests {
+		for _, policy := range []gosubst.SyntaxPolicy{gosubst.EatBadSyntax, gosubst.KeepBadSyntax} {
+			expected := test.eat
+			if policy == gosubst.KeepBadSyntax {
+				expected = test.keep
+			}
+			e.OnBadSyntax = policy
+			result, err := e.Expand(test.in)
+			if err != nil {
+				t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+			}
+			if result != expected {
+				t.Errorf("Expander.Expand(%q) with policy %d == %q; expected %q", test.in, policy, result, expected)
+			}
+		}
+	}
+
+	e.OnBadSyntax = gosubst.RejectBadSyntax
+	_, err := e.Expand("ok: ${FULL}\n${}\n  ${FULL bar} ${+x} ${FULL:} ${FULL:-${}} ${oops\nnext")
+	syntaxErr, ok := err.(*gosubst.SyntaxError)
+	if !ok {
+		t.Fatalf("Expander.Expand() has error %v; expected a *SyntaxError", err)
+	}
+	expected := []gosubst.BadSyntax{
+		{Offset: 12, Line: 2, Column: 1, Snippet: "${}", Reason: "empty name"},
+		{Offset: 18, Line: 3, Column: 3, Snippet: "${FULL bar}", Reason: "invalid operator \" bar\""},
+		{Offset: 30, Line: 3, Column: 15, Snippet: "${+x}", Reason: "invalid name \"+x\""},
+		{Offset: 36, Line: 3, Column: 21, Snippet: "${FULL:}", Reason: "missing substring offset"},
+		{Offset: 58, Line: 3, Column: 43, Snippet: "${oops", Reason: "unterminated reference"},
+	}
+	if !reflect.DeepEqual(syntaxErr.Refs, expected) {
+		t.Errorf("Expander.Expand() found bad syntax\n%+v\nexpected\n%+v", syntaxErr.Refs, expected)
+	}
+}
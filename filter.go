@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// VarFilter decides, by name, which variables the expansion pass may
+// touch. Both lists hold shell patterns (eg "APP_*"). References to
+// variables that aren't allowed are left in the output as they are,
+// which is handy for files like nginx.conf that have their own ${vars}.
+type VarFilter struct {
+	Only   []string // if not empty, only these may be expanded
+	Except []string // these may never be expanded
+	Listed bool     // Only is the whole list even if it's empty, so that nothing else may be expanded
+}
+
+// Allows reports whether the named variable may be expanded.
+func (f VarFilter) Allows(name string) bool {
+	for _, pattern := range f.Except {
+		if matchGlob(pattern, name) {
+			return false
+		}
+	}
+	if len(f.Only) == 0 && !f.Listed {
+		return true
+	}
+	for _, pattern := range f.Only {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// shellFormatVar matches the $VAR and ${VAR} references in a SHELL-FORMAT.
+var shellFormatVar = regexp.MustCompile(`\$(?:([A-Za-z_][A-Za-z0-9_]*)|\{([A-Za-z_][A-Za-z0-9_]*)\})`)
+
+// ShellFormatNames returns the names of the variables referenced in an
+// envsubst SHELL-FORMAT argument, eg "$APP_NAME ${PORT}". As envsubst
+// does, only those references count, unless there are none: then its
+// words (split on spaces and commas) are taken as names or shell
+// patterns as they are, so "APP_* PORT" works too.
+func ShellFormatNames(format string) []string {
+	var names []string
+	for _, match := range shellFormatVar.FindAllStringSubmatch(format, -1) {
+		if match[1] != "" {
+			names = append(names, match[1])
+		} else {
+			names = append(names, match[2])
+		}
+	}
+	if strings.Contains(format, "$") {
+		return names
+	}
+	for _, word := range strings.FieldsFunc(format, func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	}) {
+		names = append(names, word)
+	}
+	return names
+}
@@ -0,0 +1,73 @@
+package main_test
+
+import (
+	"reflect"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+func TestVarFilter(t *testing.T) {
+	tests := []struct {
+		filter gosubst.VarFilter
+		name   string
+		allows bool
+	}{
+		{gosubst.VarFilter{}, "ANYTHING", true},
+		{gosubst.VarFilter{Only: []string{"APP_NAME"}}, "APP_NAME", true},
+		{gosubst.VarFilter{Only: []string{"APP_NAME"}}, "host", false},
+		{gosubst.VarFilter{Only: []string{"APP_*"}}, "APP_PORT", true},
+		{gosubst.VarFilter{Only: []string{"APP_*", "PORT"}}, "PORT", true},
+		{gosubst.VarFilter{Except: []string{"host", "remote_*"}}, "remote_addr", false},
+		{gosubst.VarFilter{Except: []string{"host", "remote_*"}}, "APP_NAME", true},
+		{gosubst.VarFilter{Only: []string{"APP_*"}, Except: []string{"APP_SECRET"}}, "APP_SECRET", false},
+		{gosubst.VarFilter{Only: []string{"APP_*"}, Except: []string{"APP_SECRET"}}, "APP_NAME", true},
+		{gosubst.VarFilter{Listed: true}, "APP_NAME", false},
+		{gosubst.VarFilter{Only: []string{"APP_*"}, Listed: true}, "APP_NAME", true},
+	}
+	for _, test := range tests {
+		if allows := test.filter.Allows(test.name); allows != test.allows {
+			t.Errorf("%+v.Allows(%q) == %t; expected %t", test.filter, test.name, allows, test.allows)
+		}
+	}
+}
+
+func TestShellFormatNames(t *testing.T) {
+	tests := []struct {
+		format string
+		names  []string
+	}{
+		{"", nil},
+		{"$APP_NAME", []string{"APP_NAME"}},
+		{"$APP_NAME ${PORT}", []string{"APP_NAME", "PORT"}},
+		{"$APP_NAME,$PORT:$1 $$ ${bad", []string{"APP_NAME", "PORT"}},
+		{"APP_* PORT", []string{"APP_*", "PORT"}},
+		{"$HOST,APP_*", []string{"HOST"}},
+		{"Dear $NAME", []string{"NAME"}},
+		{"$$", nil},
+		{"none", []string{"none"}},
+	}
+	for _, test := range tests {
+		if names := gosubst.ShellFormatNames(test.format); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("ShellFormatNames(%q) == %q; expected %q", test.format, names, test.names)
+		}
+	}
+}
+
+func TestExpanderAllow(t *testing.T) {
+	e := gosubst.NewExpander(func(s string) (string, bool) {
+		return "<" + s + ">", true
+	})
+	e.Bare = true
+	e.Allow = gosubst.VarFilter{Only: []string{"APP_*"}}.Allows
+
+	input := "server_name ${APP_NAME}; proxy_set_header Host $host; ${host:-x} $APP_PORT ${APP_X:-$host}"
+	expected := "server_name <APP_NAME>; proxy_set_header Host $host; ${host:-x} <APP_PORT> <APP_X>"
+	result, err := e.Expand(input)
+	if err != nil {
+		t.Errorf("Expander.Expand(%q) has error %q; expected nil", input, err)
+	}
+	if result != expected {
+		t.Errorf("Expander.Expand(%q) == %q; expected %q", input, result, expected)
+	}
+}
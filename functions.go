@@ -34,9 +34,14 @@ func RequiredEnvs(envvars ...string) (string, error) {
 
 // RequiredVals raises an error if any of the given values return true
 // from Sprig's `empty()` function. Inspired by Helm's `required()`.
+// Secrets are checked by their values, but never print them.
 func RequiredVals(vals ...interface{}) (string, error) {
 	for _, val := range vals {
-		if empty(val) {
+		check := val
+		if secret, ok := val.(Secret); ok {
+			check = secret.Reveal()
+		}
+		if empty(check) {
 			return "", fmt.Errorf("required value is empty: %v", val)
 		}
 	}
@@ -62,11 +67,14 @@ func RequiredFiles(paths ...string) (string, error) {
 	return "", nil
 }
 
+// shell is the shell that sh() runs commands with.
+var shell = "sh"
+
 // Sh implements the `sh()` function used in the template to run
 // basic shell commands and inject their STDOUT back into the document.
 // STDERR output is attached to the err, but then is promptly ignored.
 func Sh(cmdstr string) (string, error) {
-	out, err := exec.Command("sh", "-c", cmdstr).Output()
+	out, err := exec.Command(shell, "-c", cmdstr).Output()
 	return string(out), err
 }
 
@@ -0,0 +1,1165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// NOTE: .Git is read straight from the .git directory, rather than by
+//       running git, which often isn't there in a build image. That
+//       means reading refs (loose and packed), objects (loose and packed,
+//       deltas and all), the index and the config, but only as much as
+//       the template asks for: nothing's read until it uses .Git, and the
+//       work tree is only checked for changes for .Git.Dirty (and
+//       .Git.Describe). Outside of a repository, or if it can't be read
+//       (eg it uses SHA-256), everything is empty, rather than an error.
+//       Clean filters (eg git-lfs) aren't run, so a file that's changed
+//       only on the disk's side of one may count as dirty.
+
+// shortHashLen is how much of a hash ShortCommit (and Describe) gives,
+// as git does by default.
+const shortHashLen = 7
+
+// Git is .Git: details of the git repository that a directory is in.
+// They're methods, so that each is only worked out if it's used.
+type Git struct {
+	dir string
+
+	headOnce sync.Once
+	repo     *gitRepo
+	branch   string
+	commit   string
+	time     time.Time
+	remote   string
+
+	tagOnce  sync.Once
+	tag      string
+	distance int
+
+	dirtyOnce sync.Once
+	dirty     bool
+}
+
+// NewGit returns the Git for the repository that dir is in, if any.
+func NewGit(dir string) *Git {
+	return &Git{dir: dir}
+}
+
+// loadHead reads where HEAD is.
+func (g *Git) loadHead() {
+	g.headOnce.Do(func() {
+		repo, err := findGitRepo(g.dir)
+		if err != nil || repo == nil {
+			return
+		}
+		g.repo = repo
+		g.remote = repo.remoteURL()
+		if g.branch, g.commit, err = repo.head(); err != nil || g.commit == "" {
+			return
+		}
+		if c, err := repo.readCommit(g.commit); err == nil {
+			g.time = c.time
+		}
+	})
+}
+
+// Commit is the hash of the commit that HEAD is at.
+func (g *Git) Commit() string {
+	g.loadHead()
+	return g.commit
+}
+
+// ShortCommit is Commit, abbreviated.
+func (g *Git) ShortCommit() string {
+	g.loadHead()
+	if len(g.commit) < shortHashLen {
+		return g.commit
+	}
+	return g.commit[:shortHashLen]
+}
+
+// Branch is the name of the branch that's checked out, unless HEAD is
+// detached.
+func (g *Git) Branch() string {
+	g.loadHead()
+	return g.branch
+}
+
+// Time is when HEAD's commit was committed.
+func (g *Git) Time() time.Time {
+	g.loadHead()
+	return g.time
+}
+
+// RemoteURL is the URL of the "origin" remote (or of the first remote,
+// if there's no origin), without any credentials in it.
+func (g *Git) RemoteURL() string {
+	g.loadHead()
+	return g.remote
+}
+
+// Tag is the most recent tag in HEAD's history.
+func (g *Git) Tag() string {
+	g.loadHead()
+	g.tagOnce.Do(func() {
+		if g.commit != "" {
+			g.tag, g.distance, _ = g.repo.describe(g.commit)
+		}
+	})
+	return g.tag
+}
+
+// Dirty reports whether any tracked files have uncommitted changes,
+// staged or not.
+func (g *Git) Dirty() bool {
+	g.loadHead()
+	g.dirtyOnce.Do(func() {
+		if g.repo != nil {
+			g.dirty, _ = g.repo.isDirty(g.commit)
+		}
+	})
+	return g.dirty
+}
+
+// Describe is what `git describe --tags --always --dirty` would give:
+// the Tag, with how many commits HEAD is past it and ShortCommit if it
+// isn't at it (eg "v1.2.0-3-g1a2b3c4"), or just ShortCommit if there's
+// no tag, and "-dirty" if it's Dirty.
+func (g *Git) Describe() string {
+	if g.Commit() == "" {
+		return ""
+	}
+	desc := g.ShortCommit()
+	if tag := g.Tag(); tag != "" && g.distance == 0 {
+		desc = tag
+	} else if tag != "" {
+		desc = fmt.Sprintf("%s-%d-g%s", tag, g.distance, desc)
+	}
+	if g.Dirty() {
+		desc += "-dirty"
+	}
+	return desc
+}
+
+// gitRepo reads a repository.
+type gitRepo struct {
+	gitDir    string // the .git directory (a worktree's own, if it's one)
+	commonDir string // where the objects, refs and config are
+	workTree  string
+	config    *gitConfig
+	objErr    error // why objects can't be read, if they can't
+
+	dirsOnce sync.Once
+	objDirs  []string
+	packs    []*gitPack
+	commits  map[string]*gitCommit
+}
+
+// findGitRepo finds the repository that dir is in, if any.
+func findGitRepo(dir string) (*gitRepo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if stat, err := FsBackend.Stat(dotGit); err == nil {
+			repo := &gitRepo{gitDir: dotGit, commonDir: dotGit, workTree: dir}
+			if !stat.IsDir() {
+				// A worktree (or submodule) links to its own git dir.
+				data, err := afero.ReadFile(FsBackend, dotGit)
+				if err != nil {
+					return nil, err
+				}
+				link := strings.TrimSpace(string(data))
+				if !strings.HasPrefix(link, "gitdir:") {
+					return nil, fmt.Errorf("%s: not a link to a git dir", dotGit)
+				}
+				repo.gitDir = absPath(dir, strings.TrimSpace(link[len("gitdir:"):]))
+				repo.commonDir = repo.gitDir
+			}
+			if data, err := afero.ReadFile(FsBackend, filepath.Join(repo.gitDir, "commondir")); err == nil {
+				repo.commonDir = absPath(repo.gitDir, strings.TrimSpace(string(data)))
+			}
+			if repo.config, err = readGitConfig(filepath.Join(repo.commonDir, "config")); err != nil {
+				return nil, err
+			}
+			if format := repo.config.get("extensions", "", "objectformat"); format != "" && format != "sha1" {
+				repo.objErr = fmt.Errorf("unsupported object format %q", format)
+			}
+			return repo, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// absPath returns path, relative to dir if it isn't absolute.
+func absPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// head returns the branch that HEAD is on (if any) and the commit it's
+// at (if any, as a new branch has none).
+func (r *gitRepo) head() (string, string, error) {
+	data, err := afero.ReadFile(FsBackend, filepath.Join(r.gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	head := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(head, "ref: ") {
+		return "", head, nil
+	}
+	ref := strings.TrimSpace(head[len("ref: "):])
+	commit, err := r.resolveRef(ref)
+	return strings.TrimPrefix(ref, "refs/heads/"), commit, err
+}
+
+// maxSymrefDepth is how many symbolic refs can point at each other.
+const maxSymrefDepth = 10
+
+// resolveRef returns the hash that the named ref points to, or "" if it
+// doesn't exist.
+func (r *gitRepo) resolveRef(name string) (string, error) {
+	for i := 0; i < maxSymrefDepth; i++ {
+		data, err := afero.ReadFile(FsBackend, filepath.Join(r.commonDir, filepath.FromSlash(name)))
+		if err != nil {
+			refs, _, err := r.packedRefs()
+			return refs[name], err
+		}
+		ref := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(ref, "ref: ") {
+			return ref, nil
+		}
+		name = strings.TrimSpace(ref[len("ref: "):])
+	}
+	return "", errors.New("too many levels of symbolic refs")
+}
+
+// packedRefs returns the refs in packed-refs, and the commits that any
+// annotated tags among them are peeled to.
+func (r *gitRepo) packedRefs() (map[string]string, map[string]string, error) {
+	refs, peeled := make(map[string]string), make(map[string]string)
+	data, err := afero.ReadFile(FsBackend, filepath.Join(r.commonDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return refs, peeled, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var last string
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case line == "" || line[0] == '#':
+		case line[0] == '^':
+			peeled[last] = strings.TrimSpace(line[1:])
+		default:
+			if fields := strings.Fields(line); len(fields) == 2 {
+				last = fields[1]
+				refs[last] = fields[0]
+			}
+		}
+	}
+	return refs, peeled, nil
+}
+
+// gitTag is a tag, as a candidate for Git.Tag.
+type gitTag struct {
+	name      string
+	annotated bool
+}
+
+// better reports whether t is a better name for a commit than other: as
+// git does, annotated tags are better than lightweight ones, and then
+// it's whichever sorts first (so v1.0 beats v1.0-rc1).
+func (t gitTag) better(other gitTag) bool {
+	if t.annotated != other.annotated {
+		return t.annotated
+	}
+	return t.name < other.name
+}
+
+// tags returns the best tag for each tagged commit.
+func (r *gitRepo) tags() (map[string]gitTag, error) {
+	refs, peeled, err := r.packedRefs()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for name, hash := range refs {
+		if strings.HasPrefix(name, "refs/tags/") {
+			names[name] = hash
+		}
+	}
+	afero.Walk(FsBackend, filepath.Join(r.commonDir, "refs", "tags"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		data, err := afero.ReadFile(FsBackend, path)
+		if rel, relErr := filepath.Rel(r.commonDir, path); err == nil && relErr == nil {
+			name := filepath.ToSlash(rel)
+			names[name] = strings.TrimSpace(string(data))
+			delete(peeled, name) // the loose ref overrides the packed one
+		}
+		return nil
+	})
+
+	best := make(map[string]gitTag)
+	for name, hash := range names {
+		commit, annotated := peeled[name], true
+		if commit == "" {
+			if commit, annotated, err = r.peel(hash); err != nil {
+				continue // eg a tag of a tree
+			}
+		}
+		tag := gitTag{strings.TrimPrefix(name, "refs/tags/"), annotated}
+		if cur, ok := best[commit]; !ok || tag.better(cur) {
+			best[commit] = tag
+		}
+	}
+	return best, nil
+}
+
+// peel returns the commit that the object hash is (or that the tag it
+// is points to), and whether it's a tag.
+func (r *gitRepo) peel(hash string) (string, bool, error) {
+	annotated := false
+	for i := 0; i < maxSymrefDepth; i++ {
+		typ, data, err := r.readObject(hash)
+		if err != nil {
+			return "", false, err
+		}
+		switch typ {
+		case "commit":
+			return hash, annotated, nil
+		case "tag":
+			annotated = true
+			if !bytes.HasPrefix(data, []byte("object ")) || len(data) < len("object ")+40 {
+				return "", false, fmt.Errorf("malformed tag %s", hash)
+			}
+			hash = string(data[len("object ") : len("object ")+40])
+		default:
+			return "", false, fmt.Errorf("%s is a %s, not a commit", hash, typ)
+		}
+	}
+	return "", false, errors.New("too many levels of tags")
+}
+
+// describe returns the most recent tag in the history of commit, and how
+// many commits in that history aren't in the tag's (as git describe
+// counts them).
+func (r *gitRepo) describe(commit string) (string, int, error) {
+	tags, err := r.tags()
+	if err != nil || len(tags) == 0 {
+		return "", 0, err
+	}
+
+	// Look back through the history, newest first, for a tag.
+	var tagged string
+	seen := map[string]bool{commit: true}
+	queue := &commitQueue{}
+	c, err := r.readCommit(commit)
+	if err != nil {
+		return "", 0, err
+	}
+	heap.Push(queue, c)
+	for queue.Len() > 0 {
+		c := heap.Pop(queue).(*gitCommit)
+		if _, ok := tags[c.hash]; ok {
+			tagged = c.hash
+			break
+		}
+		for _, parent := range c.parents {
+			if seen[parent] {
+				continue
+			}
+			seen[parent] = true
+			p, err := r.readCommit(parent)
+			if err != nil {
+				return "", 0, err
+			}
+			heap.Push(queue, p)
+		}
+	}
+	if tagged == "" {
+		return "", 0, nil
+	}
+
+	// Then count the commits that only commit's history has, by walking
+	// both histories together until only the tag's is left.
+	const fromCommit, fromTag = 1, 2
+	flags := make(map[string]uint8)
+	queue = &commitQueue{}
+	mark := func(hash string, flag uint8) error {
+		if flags[hash]|flag == flags[hash] {
+			return nil
+		}
+		flags[hash] |= flag
+		c, err := r.readCommit(hash)
+		if err == nil {
+			heap.Push(queue, c)
+		}
+		return err
+	}
+	interesting := func() bool {
+		for _, c := range *queue {
+			if flags[c.hash]&fromTag == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if err := mark(commit, fromCommit); err != nil {
+		return "", 0, err
+	}
+	if err := mark(tagged, fromTag); err != nil {
+		return "", 0, err
+	}
+	for queue.Len() > 0 && interesting() {
+		c := heap.Pop(queue).(*gitCommit)
+		for _, parent := range c.parents {
+			if err := mark(parent, flags[c.hash]); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	distance := 0
+	for _, flag := range flags {
+		if flag == fromCommit {
+			distance++
+		}
+	}
+	return tags[tagged].name, distance, nil
+}
+
+// gitCommit is the part of a commit that's needed.
+type gitCommit struct {
+	hash    string
+	tree    string
+	parents []string
+	time    time.Time
+}
+
+// commitQueue is a heap of commits, newest first.
+type commitQueue []*gitCommit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return q[i].time.After(q[j].time) }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(c interface{}) { *q = append(*q, c.(*gitCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// readCommit reads (and remembers) the commit hash.
+func (r *gitRepo) readCommit(hash string) (*gitCommit, error) {
+	if c, ok := r.commits[hash]; ok {
+		return c, nil
+	}
+	typ, data, err := r.readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", hash, typ)
+	}
+	c := &gitCommit{hash: hash}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break // the message
+		}
+		switch {
+		case strings.HasPrefix(line, "tree "):
+			c.tree = line[len("tree "):]
+		case strings.HasPrefix(line, "parent "):
+			c.parents = append(c.parents, line[len("parent "):])
+		case strings.HasPrefix(line, "committer "):
+			c.time, err = parseGitTime(line)
+		}
+	}
+	if c.tree == "" || err != nil {
+		return nil, fmt.Errorf("malformed commit %s", hash)
+	}
+	if r.commits == nil {
+		r.commits = make(map[string]*gitCommit)
+	}
+	r.commits[hash] = c
+	return c, nil
+}
+
+// parseGitTime parses the time at the end of a commit's committer line,
+// eg "committer A U Thor <author@example.com> 1600000000 +0100".
+func parseGitTime(line string) (time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return time.Time{}, errors.New("missing time")
+	}
+	secs, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	tz := fields[len(fields)-1]
+	hhmm, err := strconv.Atoi(tz)
+	if err != nil || len(tz) != 5 {
+		return time.Time{}, fmt.Errorf("invalid time zone %q", tz)
+	}
+	if hhmm < 0 {
+		hhmm = -hhmm
+	}
+	offset := (hhmm/100*60 + hhmm%100) * 60
+	if tz[0] == '-' {
+		offset = -offset
+	}
+	return time.Unix(secs, 0).In(time.FixedZone("", offset)), nil
+}
+
+// objectDirs returns the repository's object directories: its own, and
+// any alternates.
+func (r *gitRepo) objectDirs() []string {
+	r.loadObjectDirs()
+	return r.objDirs
+}
+
+// loadObjectDirs finds the object directories and their packs.
+func (r *gitRepo) loadObjectDirs() {
+	r.dirsOnce.Do(func() {
+		objects := filepath.Join(r.commonDir, "objects")
+		r.objDirs = []string{objects}
+		if data, err := afero.ReadFile(FsBackend, filepath.Join(objects, "info", "alternates")); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && line[0] != '#' {
+					r.objDirs = append(r.objDirs, absPath(objects, line))
+				}
+			}
+		}
+		for _, dir := range r.objDirs {
+			idxs, _ := afero.Glob(FsBackend, filepath.Join(dir, "pack", "*.idx"))
+			for _, idx := range idxs {
+				if pack, err := loadGitPack(r, idx); err == nil {
+					r.packs = append(r.packs, pack)
+				}
+			}
+		}
+	})
+}
+
+// readObject returns the type and contents of the object hash.
+func (r *gitRepo) readObject(hash string) (string, []byte, error) {
+	if r.objErr != nil {
+		return "", nil, r.objErr
+	}
+	id, err := hex.DecodeString(hash)
+	if err != nil || len(id) != sha1.Size {
+		return "", nil, fmt.Errorf("invalid object name %q", hash)
+	}
+	for _, dir := range r.objectDirs() {
+		data, err := afero.ReadFile(FsBackend, filepath.Join(dir, hash[:2], hash[2:]))
+		if err == nil {
+			return parseLooseObject(data)
+		}
+	}
+	for _, pack := range r.packs {
+		if offset, ok := pack.find(id); ok {
+			return pack.read(offset, 0)
+		}
+	}
+	return "", nil, fmt.Errorf("object %s not found", hash)
+}
+
+// parseLooseObject parses a loose object: "TYPE SIZE\0CONTENTS", zlib'd.
+func parseLooseObject(data []byte) (string, []byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, err
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", nil, err
+	}
+	nul := bytes.IndexByte(raw, 0)
+	sp := bytes.IndexByte(raw, ' ')
+	if nul < 0 || sp < 0 || sp > nul {
+		return "", nil, errors.New("malformed object")
+	}
+	return string(raw[:sp]), raw[nul+1:], nil
+}
+
+// gitPack is a pack of objects, with its (version 2) index.
+type gitPack struct {
+	repo  *gitRepo // to find the bases of REF_DELTAs in
+	path  string   // of the .pack
+	idx   []byte
+	count int
+}
+
+// loadGitPack loads the pack index at path.
+func loadGitPack(repo *gitRepo, path string) (*gitPack, error) {
+	idx, err := afero.ReadFile(FsBackend, path)
+	if err != nil {
+		return nil, err
+	}
+	const header = 8 + 256*4
+	if len(idx) < header || string(idx[:4]) != "\377tOc" || binary.BigEndian.Uint32(idx[4:]) != 2 {
+		return nil, fmt.Errorf("%s: unsupported pack index", path)
+	}
+	count := int(binary.BigEndian.Uint32(idx[8+255*4:]))
+	if len(idx) < header+count*(sha1.Size+4+4) {
+		return nil, fmt.Errorf("%s: truncated pack index", path)
+	}
+	return &gitPack{repo: repo, path: strings.TrimSuffix(path, ".idx") + ".pack", idx: idx, count: count}, nil
+}
+
+// find returns the offset of the object id in the pack, if it's there.
+func (p *gitPack) find(id []byte) (int64, bool) {
+	fanout := p.idx[8:]
+	lo := 0
+	if id[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(fanout[(int(id[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(fanout[int(id[0])*4:]))
+	names := p.idx[8+256*4:]
+	name := func(i int) []byte {
+		return names[i*sha1.Size : (i+1)*sha1.Size]
+	}
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(name(lo+i), id) >= 0
+	})
+	if i >= hi || !bytes.Equal(name(i), id) {
+		return 0, false
+	}
+	offsets := names[p.count*(sha1.Size+4):]
+	offset := int64(binary.BigEndian.Uint32(offsets[i*4:]))
+	if offset&0x80000000 != 0 {
+		large, j := offsets[p.count*4:], int(offset&0x7fffffff)
+		if len(large) < (j+1)*8 {
+			return 0, false
+		}
+		offset = int64(binary.BigEndian.Uint64(large[j*8:]))
+	}
+	return offset, true
+}
+
+// packTypes are the types of objects in packs, by number.
+var packTypes = map[byte]string{1: "commit", 2: "tree", 3: "blob", 4: "tag"}
+
+// maxDeltaDepth is how long a chain of deltas can be.
+const maxDeltaDepth = 10000
+
+// read returns the type and contents of the object at offset, where
+// depth is how many deltas have been followed to get there.
+func (p *gitPack) read(offset int64, depth int) (string, []byte, error) {
+	if depth > maxDeltaDepth {
+		return "", nil, errors.New("delta chain is too long")
+	}
+	f, err := FsBackend.Open(p.path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if offset < 0 || offset >= stat.Size() {
+		return "", nil, fmt.Errorf("%s: offset %d is out of range", p.path, offset)
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, stat.Size()-offset))
+
+	// The header is the type and the (inflated) size.
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	typ, size, shift := (b>>4)&7, uint64(b&15), uint(4)
+	for b&0x80 != 0 {
+		if b, err = r.ReadByte(); err != nil {
+			return "", nil, err
+		}
+		size |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+
+	var baseType string
+	var base []byte
+	switch typ {
+	case 6: // OFS_DELTA: on an object earlier in the pack
+		rel, err := readOffsetVarint(r)
+		if err != nil {
+			return "", nil, err
+		}
+		if baseType, base, err = p.read(offset-rel, depth+1); err != nil {
+			return "", nil, err
+		}
+	case 7: // REF_DELTA: on an object by name
+		id := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return "", nil, err
+		}
+		if baseType, base, err = p.repo.readObject(hex.EncodeToString(id)); err != nil {
+			return "", nil, err
+		}
+	default:
+		if packTypes[typ] == "" {
+			return "", nil, fmt.Errorf("%s: invalid object type %d", p.path, typ)
+		}
+	}
+
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return "", nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return "", nil, err
+	}
+	if base != nil {
+		data, err = applyDelta(base, data)
+		return baseType, data, err
+	}
+	return packTypes[typ], data, nil
+}
+
+// readOffsetVarint reads the variable-length numbers that git uses for
+// the offsets of OFS_DELTAs (and in version 4 indexes).
+func readOffsetVarint(r io.ByteReader) (int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	val := int64(b & 0x7f)
+	for b&0x80 != 0 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		val = (val+1)<<7 | int64(b&0x7f)
+	}
+	return val, nil
+}
+
+// applyDelta applies a delta to its base.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	errMalformed := errors.New("malformed delta")
+	size := func() uint64 {
+		var size uint64
+		for shift := uint(0); len(delta) > 0; shift += 7 {
+			b := delta[0]
+			delta = delta[1:]
+			size |= uint64(b&0x7f) << shift
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return size
+	}
+	if size() != uint64(len(base)) {
+		return nil, errMalformed
+	}
+	outSize := size()
+	out := make([]byte, 0, outSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0: // copy from the base
+			var fields [7]uint64
+			for i := range fields {
+				if op&(1<<uint(i)) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errMalformed
+				}
+				fields[i] = uint64(delta[0])
+				delta = delta[1:]
+			}
+			start := fields[0] | fields[1]<<8 | fields[2]<<16 | fields[3]<<24
+			n := fields[4] | fields[5]<<8 | fields[6]<<16
+			if n == 0 {
+				n = 0x10000
+			}
+			if start+n > uint64(len(base)) {
+				return nil, errMalformed
+			}
+			out = append(out, base[start:start+n]...)
+		case op != 0: // insert the next op bytes
+			if int(op) > len(delta) {
+				return nil, errMalformed
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errMalformed
+		}
+	}
+	if uint64(len(out)) != outSize {
+		return nil, errMalformed
+	}
+	return out, nil
+}
+
+// gitEntry is a file in a tree.
+type gitEntry struct {
+	mode uint32
+	hash string
+}
+
+// readTree adds the files in the tree hash (and its subtrees) to files,
+// by their paths, under prefix.
+func (r *gitRepo) readTree(hash, prefix string, files map[string]gitEntry) error {
+	typ, data, err := r.readObject(hash)
+	if err != nil {
+		return err
+	}
+	if typ != "tree" {
+		return fmt.Errorf("%s is a %s, not a tree", hash, typ)
+	}
+	for len(data) > 0 {
+		sp, nul := bytes.IndexByte(data, ' '), bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+1+sha1.Size {
+			return fmt.Errorf("malformed tree %s", hash)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return fmt.Errorf("malformed tree %s", hash)
+		}
+		path := prefix + string(data[sp+1:nul])
+		id := hex.EncodeToString(data[nul+1 : nul+1+sha1.Size])
+		data = data[nul+1+sha1.Size:]
+		if mode == 040000 {
+			if err := r.readTree(id, path+"/", files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[path] = gitEntry{mode: uint32(mode), hash: id}
+	}
+	return nil
+}
+
+// gitIndexEntry is an entry in the index.
+type gitIndexEntry struct {
+	path        string
+	mode        uint32
+	hash        string
+	size        uint32 // the size of the file when it was added (truncated)
+	mtimeSec    uint32 // and its mtime
+	mtimeNsec   uint32
+	stage       int  // not 0 for a merge conflict
+	skip        bool // marked skip-worktree or assume-unchanged
+	intentToAdd bool
+}
+
+// readGitIndex reads the entries of the index (of version 2, 3 or 4) at
+// path.
+func readGitIndex(path string) ([]gitIndexEntry, error) {
+	data, err := afero.ReadFile(FsBackend, path)
+	if err != nil {
+		return nil, err
+	}
+	errMalformed := fmt.Errorf("%s: malformed index", path)
+	if len(data) < 12 || string(data[:4]) != "DIRC" {
+		return nil, errMalformed
+	}
+	version := binary.BigEndian.Uint32(data[4:])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("%s: unsupported index version %d", path, version)
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	entries := make([]gitIndexEntry, 0, count)
+	pos, prev := 12, ""
+	for i := 0; i < count; i++ {
+		if len(data) < pos+62 {
+			return nil, errMalformed
+		}
+		e := data[pos:]
+		entry := gitIndexEntry{
+			mtimeSec:  binary.BigEndian.Uint32(e[8:]),
+			mtimeNsec: binary.BigEndian.Uint32(e[12:]),
+			mode:      binary.BigEndian.Uint32(e[24:]),
+			size:      binary.BigEndian.Uint32(e[36:]),
+			hash:      hex.EncodeToString(e[40:60]),
+		}
+		flags := binary.BigEndian.Uint16(e[60:])
+		entry.stage = int(flags>>12) & 3
+		entry.skip = flags&0x8000 != 0
+		n := 62
+		if flags&0x4000 != 0 && version >= 3 {
+			if len(e) < 64 {
+				return nil, errMalformed
+			}
+			extended := binary.BigEndian.Uint16(e[62:])
+			entry.skip = entry.skip || extended&0x4000 != 0
+			entry.intentToAdd = extended&0x2000 != 0
+			n = 64
+		}
+		if version == 4 {
+			// Paths are compressed: how much of the last one to drop,
+			// and then what to add to it.
+			r := bytes.NewReader(e[n:])
+			strip, err := readOffsetVarint(r)
+			if err != nil || strip > int64(len(prev)) {
+				return nil, errMalformed
+			}
+			n = len(e) - r.Len()
+			nul := bytes.IndexByte(e[n:], 0)
+			if nul < 0 {
+				return nil, errMalformed
+			}
+			entry.path = prev[:len(prev)-int(strip)] + string(e[n:n+nul])
+			pos += n + nul + 1
+		} else {
+			nul := bytes.IndexByte(e[n:], 0)
+			if nul < 0 {
+				return nil, errMalformed
+			}
+			entry.path = string(e[n : n+nul])
+			pos += (n + nul + 8) &^ 7
+		}
+		prev = entry.path
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// isDirty reports whether the index differs from commit (as a new branch
+// with no commit, nothing), or the work tree from the index.
+func (r *gitRepo) isDirty(commit string) (bool, error) {
+	if r.objErr != nil {
+		return false, r.objErr
+	}
+	indexPath := filepath.Join(r.gitDir, "index")
+	entries, err := readGitIndex(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	var indexTime time.Time
+	if stat, err := FsBackend.Stat(indexPath); err == nil {
+		indexTime = stat.ModTime()
+	}
+	head := make(map[string]gitEntry)
+	if commit != "" {
+		c, err := r.readCommit(commit)
+		if err != nil {
+			return false, err
+		}
+		if err := r.readTree(c.tree, "", head); err != nil {
+			return false, err
+		}
+	}
+
+	// Staged changes: the index against the commit. A sparse index has
+	// directories in it, standing in for everything under them.
+	matched := 0
+	for _, e := range entries {
+		if e.stage != 0 || e.intentToAdd {
+			return true, nil
+		}
+		if e.mode == 040000 {
+			for path := range head {
+				if strings.HasPrefix(path, e.path) {
+					matched++
+				}
+			}
+			continue
+		}
+		if h, ok := head[e.path]; !ok || h.hash != e.hash || h.mode != e.mode {
+			return true, nil
+		}
+		matched++
+	}
+	if matched != len(head) {
+		return true, nil
+	}
+
+	// Unstaged changes: the work tree against the index.
+	fileMode := r.config.get("core", "", "filemode") != "false"
+	for _, e := range entries {
+		if e.skip || e.mode == 040000 || e.mode == 0160000 {
+			continue
+		}
+		if r.changed(e, indexTime, fileMode) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// changed reports whether the file in the work tree for an index entry
+// has changed since it was added. As git does, the file is only hashed
+// if it's been touched since (or at the same time as) the index was
+// written.
+func (r *gitRepo) changed(e gitIndexEntry, indexTime time.Time, fileMode bool) bool {
+	path := filepath.Join(r.workTree, filepath.FromSlash(e.path))
+	var info os.FileInfo
+	var err error
+	if lstater, ok := FsBackend.(afero.Lstater); ok {
+		info, _, err = lstater.LstatIfPossible(path)
+	} else {
+		info, err = FsBackend.Stat(path)
+	}
+	if err != nil {
+		return true // deleted, or as good as
+	}
+	isLink := info.Mode()&os.ModeSymlink != 0
+	switch {
+	case isLink != (e.mode == 0120000):
+		return true
+	case !isLink && !info.Mode().IsRegular():
+		return true
+	case !isLink && fileMode && (info.Mode()&0100 != 0) != (e.mode == 0100755):
+		return true
+	}
+
+	mtime := info.ModTime()
+	if uint32(info.Size()) == e.size && uint32(mtime.Unix()) == e.mtimeSec &&
+		uint32(mtime.Nanosecond()) == e.mtimeNsec && mtime.Before(indexTime) {
+		return false
+	}
+	var content []byte
+	if isLink {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return true
+		}
+		content = []byte(filepath.ToSlash(target))
+	} else if content, err = afero.ReadFile(FsBackend, path); err != nil {
+		return true
+	}
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", len(content))
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil)) != e.hash
+}
+
+// gitConfig is the part of a git config file that's needed.
+type gitConfig struct {
+	values  map[string]string // by "section.subsection.key"
+	remotes []string          // the names of the remotes, in order
+}
+
+// readGitConfig reads the git config file at path, if there is one.
+func readGitConfig(path string) (*gitConfig, error) {
+	config := &gitConfig{values: make(map[string]string)}
+	data, err := afero.ReadFile(FsBackend, path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var section, subsection string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%s: malformed section %q", path, line)
+			}
+			header := line[1:end]
+			section, subsection = strings.ToLower(header), ""
+			if sp := strings.IndexByte(header, ' '); sp >= 0 {
+				section = strings.ToLower(header[:sp])
+				subsection = strings.Trim(strings.TrimSpace(header[sp+1:]), `"`)
+			}
+			if section == "remote" && subsection != "" {
+				known := false
+				for _, name := range config.remotes {
+					known = known || name == subsection
+				}
+				if !known {
+					config.remotes = append(config.remotes, subsection)
+				}
+			}
+		default:
+			key, val := line, "true"
+			if eq := strings.IndexByte(line, '='); eq >= 0 {
+				key, val = strings.TrimSpace(line[:eq]), gitConfigValue(line[eq+1:])
+			}
+			config.values[section+"."+subsection+"."+strings.ToLower(key)] = val
+		}
+	}
+	return config, nil
+}
+
+// gitConfigValue unquotes a value from a config file, dropping any
+// comment after it.
+func gitConfigValue(s string) string {
+	var b strings.Builder
+	quoted, trailing := false, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			trailing = 0
+			continue
+		case c == '\\' && i+1 < len(s):
+			i++
+			c = map[byte]byte{'n': '\n', 't': '\t', 'b': '\b'}[s[i]]
+			if c == 0 {
+				c = s[i]
+			}
+		case !quoted && (c == '#' || c == ';'):
+			i = len(s)
+			continue
+		case !quoted && (c == ' ' || c == '\t'):
+			if b.Len() == 0 {
+				continue
+			}
+			trailing++
+		default:
+			trailing = 0
+		}
+		b.WriteByte(c)
+	}
+	val := b.String()
+	return val[:len(val)-trailing]
+}
+
+// get returns the value of a key in the config.
+func (c *gitConfig) get(section, subsection, key string) string {
+	return c.values[section+"."+subsection+"."+key]
+}
+
+// remoteURL returns the URL of the origin remote, or of the first one
+// if there's no origin, without any credentials.
+func (r *gitRepo) remoteURL() string {
+	name := "origin"
+	if r.config.get("remote", name, "url") == "" && len(r.config.remotes) > 0 {
+		name = r.config.remotes[0]
+	}
+	raw := r.config.get("remote", name, "url")
+	if u, err := url.Parse(raw); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return raw
+}
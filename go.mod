@@ -5,5 +5,7 @@ go 1.13
 require (
 	github.com/Masterminds/sprig/v3 v3.0.2
 	github.com/spf13/afero v1.2.2
+	golang.org/x/crypto v0.0.0-20190911031432-227b76d455e7
+	gopkg.in/yaml.v2 v2.2.2
 	gotest.tools/v3 v3.0.1
 )
@@ -14,13 +14,70 @@ var (
 
 // HelpText is the poor man's man for the CLI.
 var HelpText = `
-Usage: gosubst [OPTION]
+Usage: gosubst [OPTION] [SHELL-FORMAT]
+       gosubst encrypt|decrypt [--key-file=FILE] [FILE]...
 
 Substitutes the values of environment variables.
 
 Options:
-  -e, --expand-only           skip the Go templating pass
+  -e, --expand-only           skip the Go templating pass (and stream the
+                              input through, rather than reading it all)
   -t, --template-only         skip env variable expansion pass
+      --shell-vars, --bare    also expand variables of the form $VARIABLE
+      --syntax=SYNTAX         the delimiters of references to expand: one
+                              of dollar (${VAR}, the default), backslash
+                              (escaped as \${VAR}), percent (%{VAR}), at
+                              (@VAR@) or brackets ([[VAR]]), or the
+                              delimiters themselves, eg '<< >> \<<'
+      --expand-depth=N        expand references in the values of variables
+                              too, up to N levels deep
+      --escape=FORMAT         escape values to suit where they're expanded
+                              in yaml, json, shell or xml (or none)
+      --clean-env             hide the whole environment (from expansion,
+                              .Env, requiredEnvs, env and expandenv and
+                              sh), except for any --env-file variables
+      --pass-env VARS         with --clean-env (which it implies), keep
+                              these variables (comma-separated, and globs
+                              like APP_* are allowed)
+      --profile=NAME          load values.yaml, values.NAME.yaml, .env and
+                              .env.NAME (as there are) before any -f and
+                              --env-file files, and set .Profile to NAME
+      --env-file=FILE         load variables from a dotenv file, under the
+                              real environment (may be repeated, with later
+                              files overriding earlier ones)
+  -f, --values=FILE           merge a YAML or JSON file into .Values (may be
+                              repeated, with later files overriding earlier
+                              ones)
+      --set PATH=VALUE        set a value in .Values, after any files, as
+                              Helm does (eg image.tag=1.2, list[0]=a,
+                              list={a,b}, a\.b=c); numbers and booleans
+                              are typed, and several may be given at once,
+                              separated by commas
+      --set-string PATH=VALUE like --set, but the values are all strings
+      --set-file PATH=FILE    like --set, but the value is a file's contents
+      --key-file=FILE         the key to decrypt ENC[...] values with (or
+                              set $GOSUBST_KEY to the key itself)
+      --secrets-dir=DIR       load each file in DIR into .Secrets (may be
+                              repeated; defaults to $CREDENTIALS_DIRECTORY)
+      --schema=FILE           validate .Values against a JSON Schema before
+                              templating (as is any values file's sibling
+                              *.schema.json, eg values.schema.json)
+      --skip-literals         don't expand references in template comments
+                              and raw (backquoted) strings
+      --only VARS             only expand these variables (comma-separated,
+                              and globs like APP_* are allowed)
+      --except VARS           never expand these variables
+  -u, --strict                fail if any expanded variable is unset (or
+                              empty), listing them all, before templating
+      --allow-empty           with --strict, allow set but empty variables
+      --on-bad-syntax=POLICY  what to do with malformed references like
+                              "${" or "${}": eat them (the default), keep
+                              them as they are, or error
+      --variables             list the variables referenced by the input
+                              (by expansion and by requiredEnvs, env and
+                              expandenv in the template) and exit
+      --json                  with --variables, list them as JSON
+      --unset                 with --variables, list only unset ones
       --debug                 set the template context .Debug val true
   -h, --help                  display this help and exit
   -V, --version               output version information and exit
@@ -28,13 +85,38 @@ Options:
 When gosubst is invoked standard input is copied to standard output,
 with references to environment variables of the form ${VARIABLE}
 being replaced with the corresponding values first (as in ` + "`envsubst`" + `), and
-then passed through the Go templating engine.
+then passed through the Go templating engine. As with envsubst, if a
+SHELL-FORMAT is given (eg '$APP_NAME $PORT', or if it has no $ in it,
+names and globs, as in 'APP_* PORT') only the variables it names are
+expanded, and any others are left as they are. The shell's parameter
+operators ${VARIABLE:-default}, ${VARIABLE:=default}, ${VARIABLE:+alt}
+and ${VARIABLE:?message} (and their colon-less forms) are supported, as
+are bash's ${#VARIABLE}, ${VARIABLE#pattern}, ${VARIABLE%pattern},
+${VARIABLE/pattern/string}, ${VARIABLE:offset:length}, ${VARIABLE^^} and
+${VARIABLE,,} (and friends). Names may be nested, as in
+${DB_${DEPLOY_ENV}_HOST}, ${!VARIABLE} is indirect,
+${VARIABLE@FORMAT} escapes a single value as --escape does, and a
+reference may end in a pipeline of the template's functions, as in
+${VARIABLE|lower|trunc 63}. References may also name a scheme:
+${env:VARIABLE} is ${VARIABLE}, ${file:PATH} is the contents of a file,
+and ${cmd:COMMAND} is the output of a shell command. Nothing between
+{{/* gosubst:noexpand */}} and {{/* gosubst:expand */}} is expanded.
 
 For the Go template, the global context some environmental variables and
-information about the currently running process as .Proc and the command
-line boolean option --debug as .Debug. Also included in the template are
-the suite of Sprig <http://masterminds.github.io/sprig/> functions and a
-special ` + "`sh()`" + ` function that evals the given string with` + "`sh -c '...'`" + `.
+information about the currently running process as .Proc, the environment
+as .Env (a map, for range and hasKey), the command line boolean option
+--debug as .Debug, the --profile as .Profile, and the values files given
+with --values (deep-merged in order, as Helm does) as .Values. Values files may
+have encrypted values, as written by ` + "`gosubst encrypt FILE`" + ` (which
+encrypts every value in FILE in place, and ` + "`decrypt`" + ` undoes it, for
+editing) with a key of 32 random bytes, base64'd. The files in the
+secrets directories are .Secrets, which print as [REDACTED] unless asked
+for by name, as in .Secrets.db_password.Reveal. The git repository the
+working directory is in (read without running git) is .Git, with
+.Git.Commit, .ShortCommit, .Branch, .Tag, .Describe, .Dirty, .RemoteURL
+and .Time, all empty outside of one. Also included in the template are
+the suite of Sprig <http://masterminds.github.io/sprig/>
+functions and a special ` + "`sh()`" + ` function that evals the given string with` + "`sh -c '...'`" + `.
 Use sh at your own peril!
 
 For more information, email <p+gosubst@hews.co>, or visit the project page
@@ -14,11 +14,16 @@ import (
 )
 
 // GlobalContext represents the values that will be available at the
-// top level (ie "$.") in the template. This is where .Proc and .Debug
-// come from.
+// top level (ie "$.") in the template. This is where .Proc, .Env, .Debug,
+// .Profile, .Values, .Secrets and .Git come from.
 type GlobalContext struct {
-	Proc  ProcessDetails
-	Debug bool
+	Proc    ProcessDetails
+	Env     map[string]interface{}
+	Debug   bool
+	Profile string
+	Values  map[string]interface{}
+	Secrets map[string]interface{}
+	Git     *Git
 }
 
 // ProcessDetails are just a grab bag of things we may want to know and
@@ -44,43 +49,61 @@ type ProcessDetails struct {
 	PWD           string
 }
 
+// inputName is what the input is called in errors from the template.
+const inputName = "<stdin>"
+
 // Allow us to use log.Fatalf w/o timestamps, and to test output.
 var elog = log.New(os.Stderr, "gosubst: ", 0)
 var olog = log.New(os.Stdout, "", 0)
 
 func main() {
-	var (
-		doExpand   = true
-		doTemplate = true
-		debug      = false
-	)
-
-	// NOTE: the "flags" package is ugly, and this is simple.
-	for _, arg := range os.Args[1:] {
-		if arg == "-V" || arg == "--version" {
-			PrintVersion(olog)
-			os.Exit(0)
-		}
-		if arg == "-h" || arg == "--help" {
-			PrintHelp(olog)
-			os.Exit(0)
-		}
-		if arg == "-t" || arg == "--template-only" {
-			if !doTemplate {
-				elog.Fatalf("invalid options: must expand or template")
-			}
-			doExpand = false
-		}
-		if arg == "-e" || arg == "--expand-only" {
-			if !doExpand {
-				elog.Fatalf("invalid options: must expand or template")
-			}
-			doTemplate = false
+	// The encrypt and decrypt subcommands are for editing encrypted
+	// values files.
+	if len(os.Args) > 1 && (os.Args[1] == "encrypt" || os.Args[1] == "decrypt") {
+		if err := Crypt(os.Args[1:], os.Getenv(KeyEnv), os.Stdin, os.Stdout); err != nil {
+			elog.Fatalf("%s", err)
 		}
-		if arg == "--debug" {
-			debug = true
+		os.Exit(0)
+	}
+
+	opts, err := ParseOptions(os.Args[1:])
+	if err != nil {
+		elog.Fatalf("%s", err)
+	}
+	if opts.Version {
+		PrintVersion(olog)
+		os.Exit(0)
+	}
+	if opts.Help {
+		PrintHelp(olog)
+		os.Exit(0)
+	}
+
+	// A profile picks its own values files and dotenv files.
+	if err := opts.ApplyProfile(); err != nil {
+		elog.Fatalf("invalid options: %s", err)
+	}
+
+	// Take the key for encrypted values out of the environment, so that
+	// the template (and anything it runs) can't see it.
+	opts.Key = os.Getenv(KeyEnv)
+	os.Unsetenv(KeyEnv)
+
+	// Secrets come from systemd's credentials, unless they're elsewhere.
+	if len(opts.SecretsDirs) == 0 && os.Getenv(CredentialsEnv) != "" {
+		opts.SecretsDirs = []string{os.Getenv(CredentialsEnv)}
+	}
+
+	// Restrict the environment to what's asked for, and then load any
+	// dotenv files under it, so that every pass sees the same variables.
+	if opts.CleanEnv {
+		if err := CleanEnv(opts.PassEnv...); err != nil {
+			elog.Fatalf("%s", err)
 		}
 	}
+	if err := LoadEnvFiles(opts.EnvFiles...); err != nil {
+		elog.Fatalf("invalid env file: %s", err)
+	}
 
 	// Check the current mode of STDIN.
 	info, err := os.Stdin.Stat()
@@ -89,13 +112,52 @@ func main() {
 	}
 	reader := bufio.NewReader(os.Stdin)
 
+	// Just list the variables referenced by the input, if asked.
+	if opts.List {
+		bytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			panic(err)
+		}
+		vars, err := Variables(string(bytes), opts, os.LookupEnv)
+		if err != nil {
+			elog.Fatalf("input is invalid: %s\n", err)
+		}
+		if opts.Unset {
+			var unset []Variable
+			for _, v := range vars {
+				if !v.Set {
+					unset = append(unset, v)
+				}
+			}
+			vars = unset
+		}
+		if err := PrintVariables(os.Stdout, vars, opts.JSON); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+
 	// Slurp up whatever has been piped if it's hanging out in STDIN...
 	if (info.Mode() & os.ModeCharDevice) == 0 {
+		// With nothing to template, there's no need to hold all of the
+		// input (or output) in memory: stream it through instead. Not in
+		// --strict mode though, where nothing is output if it fails.
+		if !opts.Template && !opts.Strict && opts.BadSyntax != RejectBadSyntax {
+			out := bufio.NewWriter(os.Stdout)
+			err := opts.expander(os.LookupEnv).ExpandStream(out, reader)
+			if flushErr := out.Flush(); err == nil {
+				err = flushErr
+			}
+			if err != nil {
+				elog.Fatalf("input is invalid: %s\n", err)
+			}
+			os.Exit(0)
+		}
 		bytes, err := ioutil.ReadAll(reader)
 		if err != nil {
 			panic(err)
 		}
-		output, err := Template(string(bytes), doExpand, doTemplate, debug)
+		output, err := Render(string(bytes), opts)
 		if err != nil {
 			elog.Fatalf("input is invalid: %s\n", err)
 		}
@@ -112,7 +174,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		output, err := Template(str, doExpand, doTemplate, debug)
+		output, err := Render(str, opts)
 		if err != nil {
 			elog.Fatalf("input is invalid: %s\n", err)
 		}
@@ -131,9 +193,9 @@ func Process() ProcessDetails {
 		Hostname:      must(os.Hostname()),
 		Executable:    must(os.Executable()),
 		TempDir:       os.TempDir(),
-		UserCacheDir:  must(os.UserCacheDir()),
-		UserConfigDir: must(os.UserConfigDir()),
-		UserHomeDir:   must(os.UserHomeDir()),
+		UserCacheDir:  maybe(os.UserCacheDir()),
+		UserConfigDir: maybe(os.UserConfigDir()),
+		UserHomeDir:   maybe(os.UserHomeDir()),
 		User:          os.Getenv("USER"),
 		Shell:         os.Getenv("SHELL"),
 		Term:          os.Getenv("TERM"),
@@ -145,32 +207,62 @@ func Process() ProcessDetails {
 // Template actually runs the templating mechanisms over input, returning
 // the result if no errors are encountered.
 func Template(input string, doExpand, doTemplate, debug bool) (string, error) {
+	opts := DefaultOptions()
+	opts.Expand = doExpand
+	opts.Template = doTemplate
+	opts.Debug = debug
+	return Render(input, opts)
+}
+
+// Render runs the passes selected by opts over input, returning the
+// result if no errors are encountered.
+func Render(input string, opts Options) (string, error) {
 	var buf bytes.Buffer
 	var str string
+	var srcmap *SourceMap
 
-	// Expand env vars in the input.
-	if doExpand {
-		str = Expand(input, os.Getenv)
+	// Expand env vars in the input, keeping track of where everything
+	// came from for the template's errors.
+	if opts.Expand {
+		expanded, m, err := opts.expander(os.LookupEnv).ExpandMapped(input)
+		if err != nil {
+			return "", err
+		}
+		str, srcmap = expanded, m
 	} else {
 		str = input
 	}
 
 	// Compile and then execute the input as a Go template, including the
 	// functions from Sprig (and sh()).
-	if doTemplate {
-		tmpl, err := template.New("<stdin>").
+	if opts.Template {
+		values, err := opts.values()
+		if err != nil {
+			return "", err
+		}
+		secrets, err := LoadSecrets(opts.SecretsDirs...)
+		if err != nil {
+			return "", fmt.Errorf("invalid secrets dir: %s", err)
+		}
+		tmpl, err := template.New(inputName).
 			Funcs(sprig.TxtFuncMap()).
 			Funcs(FuncMap()).
 			Parse(str)
 		if err != nil {
-			return "", err
+			return "", srcmap.Rewrite(err, inputName)
 		}
+		proc := Process()
 		err = tmpl.Execute(&buf, &GlobalContext{
-			Proc:  Process(),
-			Debug: debug,
+			Proc:    proc,
+			Env:     Environment(),
+			Debug:   opts.Debug,
+			Profile: opts.Profile,
+			Values:  values,
+			Secrets: secrets,
+			Git:     NewGit(proc.CWD),
 		})
 		if err != nil {
-			return "", err
+			return "", srcmap.Rewrite(err, inputName)
 		}
 		str = buf.String()
 	}
@@ -184,3 +276,12 @@ func must(str string, err error) string {
 	}
 	return str
 }
+
+// maybe is must for what may well be missing, eg the user's directories
+// when there's no $HOME (as with --clean-env).
+func maybe(str string, err error) string {
+	if err != nil {
+		return ""
+	}
+	return str
+}
@@ -19,10 +19,6 @@ func TestProcess(t *testing.T) {
 	}
 }
 
-func TestOptions(t *testing.T) {
-	t.Skip("TODO implementation")
-}
-
 func TestStdinModePipe(t *testing.T) {
 	t.Skip("TODO implementation")
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Options are the command line switches that shape a run.
+type Options struct {
+	Expand      bool         // run the env variable expansion pass
+	Template    bool         // run the Go templating pass
+	Debug       bool         // the value of .Debug in the template context
+	Profile     string       // the environment's profile, eg "prod" (and .Profile)
+	Bare        bool         // expand $VAR as well as ${VAR}
+	Only        []string     // if given, only expand variables matching these
+	Except      []string     // never expand variables matching these
+	Format      bool         // a SHELL-FORMAT was given, so only Only may be expanded, even if it's empty
+	Strict      bool         // fail if any expanded variable isn't set
+	AllowEmpty  bool         // in Strict mode, allow set but empty variables
+	BadSyntax   SyntaxPolicy // what to do with malformed references
+	Syntax      Syntax       // the delimiters of references (if not the default)
+	Depth       int          // how many times to expand references in variables' values
+	Escape      Escaping     // how to escape the values of references
+	Literals    bool         // leave template comments and raw strings alone
+	EnvFiles    []string     // dotenv files to load variables from, in order
+	CleanEnv    bool         // hide the environment, except for PassEnv
+	PassEnv     []string     // with CleanEnv, the variables to keep
+	Values      []string     // values files to merge into .Values, in order
+	Set         []string     // --set assignments to .Values, eg "a.b=1"
+	SetString   []string     // --set-string assignments, of strings
+	SetFile     []string     // --set-file assignments, of files' contents
+	Schemas     []string     // JSON Schemas to validate .Values against
+	KeyFile     string       // the key file for encrypted values
+	Key         string       // the key itself, if there's no KeyFile (ie $GOSUBST_KEY)
+	SecretsDirs []string     // directories of files to load into .Secrets
+	List        bool         // list the variables referenced by the input and exit
+	JSON        bool         // list the variables as JSON
+	Unset       bool         // list only the variables that aren't set
+	Version     bool         // print version information and exit
+	Help        bool         // print help and exit
+}
+
+// DefaultOptions are the Options when no switches are given.
+func DefaultOptions() Options {
+	return Options{
+		Expand:   true,
+		Template: true,
+	}
+}
+
+// valueOptions are the options that take an argument, either as
+// "--name=value" or as "--name value".
+var valueOptions = map[string]bool{
+	"--only":          true,
+	"--except":        true,
+	"--on-bad-syntax": true,
+	"--syntax":        true,
+	"--expand-depth":  true,
+	"--escape":        true,
+	"--env-file":      true,
+	"--pass-env":      true,
+	"-f":              true,
+	"--values":        true,
+	"--set":           true,
+	"--set-string":    true,
+	"--set-file":      true,
+	"--schema":        true,
+	"--key-file":      true,
+	"--secrets-dir":   true,
+	"--profile":       true,
+}
+
+// ParseOptions reads Options from the given command line arguments (ie
+// os.Args[1:]).
+func ParseOptions(args []string) (Options, error) {
+	opts := DefaultOptions()
+
+	// NOTE: the "flags" package is ugly, and this is simple.
+	for i := 0; i < len(args); i++ {
+		arg, val, hasVal := args[i], "", false
+		if eq := strings.IndexByte(arg, '='); strings.HasPrefix(arg, "--") && eq >= 0 {
+			arg, val, hasVal = arg[:eq], arg[eq+1:], true
+		}
+		if valueOptions[arg] && !hasVal {
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("invalid options: %s requires an argument", arg)
+			}
+			i++
+			val = args[i]
+		} else if hasVal && !valueOptions[arg] {
+			return opts, fmt.Errorf("invalid options: %s doesn't allow an argument", arg)
+		}
+
+		switch arg {
+		case "-V", "--version":
+			opts.Version = true
+			return opts, nil
+		case "-h", "--help":
+			opts.Help = true
+			return opts, nil
+		case "-t", "--template-only":
+			if !opts.Template {
+				return opts, errors.New("invalid options: must expand or template")
+			}
+			opts.Expand = false
+		case "-e", "--expand-only":
+			if !opts.Expand {
+				return opts, errors.New("invalid options: must expand or template")
+			}
+			opts.Template = false
+		case "--debug":
+			opts.Debug = true
+		case "--shell-vars", "--bare":
+			opts.Bare = true
+		case "--variables":
+			opts.List = true
+		case "--json":
+			opts.JSON = true
+		case "--unset":
+			opts.Unset = true
+		case "-u", "--strict":
+			opts.Strict = true
+		case "--allow-empty":
+			opts.AllowEmpty = true
+		case "--skip-literals":
+			opts.Literals = true
+		case "--on-bad-syntax":
+			policy, err := ParseSyntaxPolicy(val)
+			if err != nil {
+				return opts, fmt.Errorf("invalid options: %s", err)
+			}
+			opts.BadSyntax = policy
+		case "--syntax":
+			syn, err := ParseSyntax(val)
+			if err != nil {
+				return opts, fmt.Errorf("invalid options: %s", err)
+			}
+			opts.Syntax = syn
+		case "--expand-depth":
+			depth, err := strconv.Atoi(val)
+			if err != nil || depth < 0 {
+				return opts, fmt.Errorf("invalid options: %s must be a number, not %q", arg, val)
+			}
+			opts.Depth = depth
+		case "--escape":
+			esc, err := ParseEscaping(val)
+			if err != nil {
+				return opts, fmt.Errorf("invalid options: %s", err)
+			}
+			opts.Escape = esc
+		case "--clean-env":
+			opts.CleanEnv = true
+		case "--pass-env":
+			opts.CleanEnv = true
+			opts.PassEnv = append(opts.PassEnv, splitList(val)...)
+		case "--env-file":
+			opts.EnvFiles = append(opts.EnvFiles, val)
+		case "-f", "--values":
+			opts.Values = append(opts.Values, val)
+		case "--set":
+			opts.Set = append(opts.Set, val)
+		case "--set-string":
+			opts.SetString = append(opts.SetString, val)
+		case "--set-file":
+			opts.SetFile = append(opts.SetFile, val)
+		case "--schema":
+			opts.Schemas = append(opts.Schemas, val)
+		case "--key-file":
+			opts.KeyFile = val
+		case "--secrets-dir":
+			opts.SecretsDirs = append(opts.SecretsDirs, val)
+		case "--profile":
+			if !validProfile(val) {
+				return opts, fmt.Errorf("invalid options: invalid profile %q", val)
+			}
+			opts.Profile = val
+		case "--only":
+			opts.Only = append(opts.Only, splitList(val)...)
+		case "--except":
+			opts.Except = append(opts.Except, splitList(val)...)
+		default:
+			if len(arg) > 1 && strings.HasPrefix(arg, "-") {
+				return opts, fmt.Errorf("invalid options: unrecognized option %q", arg)
+			}
+			// Otherwise it's envsubst's SHELL-FORMAT, eg '$HOME $USER'.
+			// As with envsubst, one that names nothing expands nothing.
+			opts.Format = true
+			opts.Only = append(opts.Only, ShellFormatNames(arg)...)
+		}
+	}
+	return opts, nil
+}
+
+// splitList splits a comma-separated option value, dropping any blanks.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// expander returns an Expander, set up as opts say, that looks up
+// variables with lookup.
+func (opts Options) expander(lookup func(string) (string, bool)) *Expander {
+	e := NewExpander(lookup)
+	e.Bare = opts.Bare
+	e.Strict = opts.Strict
+	e.AllowEmpty = opts.AllowEmpty
+	e.OnBadSyntax = opts.BadSyntax
+	e.Syntax = opts.Syntax
+	e.ExpandDepth = opts.Depth
+	e.Escape = opts.Escape
+	e.SkipLiterals = opts.Literals
+	e.Resolvers = DefaultResolvers()
+	e.SystemFilters = true
+	if len(opts.Only) > 0 || len(opts.Except) > 0 || opts.Format {
+		e.Allow = VarFilter{Only: opts.Only, Except: opts.Except, Listed: opts.Format}.Allows
+	}
+	return e
+}
+
+// values returns the template's .Values: the values files, deep-merged
+// in order, and then (as Helm does it) the --set, --set-string and
+// --set-file assignments, each in order. Encrypted values are decrypted,
+// and the result is validated against opts' schemas.
+func (opts Options) values() (map[string]interface{}, error) {
+	values, err := LoadValues(opts.Values...)
+	if err != nil {
+		return nil, err
+	}
+	sets := []struct {
+		name   string
+		assign []string
+		set    func(map[string]interface{}, string) error
+	}{
+		{"--set", opts.Set, SetValues},
+		{"--set-string", opts.SetString, SetStringValues},
+		{"--set-file", opts.SetFile, SetFileValues},
+	}
+	for _, set := range sets {
+		for _, assign := range set.assign {
+			if err := set.set(values, assign); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %s", set.name, assign, err)
+			}
+		}
+	}
+
+	key, err := opts.key()
+	if err != nil {
+		return nil, err
+	}
+	if err := DecryptValues(values, key); err != nil {
+		return nil, fmt.Errorf("invalid values: %s", err)
+	}
+
+	for _, path := range opts.schemas() {
+		schema, err := LoadSchema(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %s", err)
+		}
+		if err := schema.Validate(values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// key returns the key for encrypted values, if there is one.
+func (opts Options) key() (*Key, error) {
+	switch {
+	case opts.KeyFile != "":
+		key, err := LoadKey(opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file: %s", err)
+		}
+		return key, nil
+	case opts.Key != "":
+		key, err := ParseKey(opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $%s: %s", KeyEnv, err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// schemas returns the paths of the JSON Schemas that .Values must match:
+// those given with --schema, and then the sibling "*.schema.json" of any
+// values file that has one.
+func (opts Options) schemas() []string {
+	paths := append([]string(nil), opts.Schemas...)
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		seen[filepath.Clean(path)] = true
+	}
+	for _, path := range opts.Values {
+		path = SchemaPath(path)
+		if seen[filepath.Clean(path)] {
+			continue
+		}
+		if stat, err := FsBackend.Stat(path); err == nil && !stat.IsDir() {
+			paths = append(paths, path)
+			seen[filepath.Clean(path)] = true
+		}
+	}
+	return paths
+}
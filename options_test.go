@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+func TestOptions(t *testing.T) {
+	defaults := gosubst.DefaultOptions()
+	with := func(change func(*gosubst.Options)) gosubst.Options {
+		opts := defaults
+		change(&opts)
+		return opts
+	}
+
+	tests := []struct {
+		args []string
+		opts gosubst.Options
+		err  string
+	}{
+		{[]string{}, defaults, ""},
+		{[]string{"-e"}, with(func(o *gosubst.Options) { o.Template = false }), ""},
+		{[]string{"--template-only"}, with(func(o *gosubst.Options) { o.Expand = false }), ""},
+		{[]string{"-t", "-e"}, defaults, "must expand or template"},
+		{[]string{"--debug", "--bare"}, with(func(o *gosubst.Options) { o.Debug, o.Bare = true, true }), ""},
+		{[]string{"--shell-vars"}, with(func(o *gosubst.Options) { o.Bare = true }), ""},
+		{[]string{"-V", "--nope"}, with(func(o *gosubst.Options) { o.Version = true }), ""},
+		{[]string{"--help"}, with(func(o *gosubst.Options) { o.Help = true }), ""},
+		{[]string{"--nope"}, defaults, "unrecognized option \"--nope\""},
+		{[]string{"--only", "APP_*,PORT", "--only=HOST"}, with(func(o *gosubst.Options) { o.Only = []string{"APP_*", "PORT", "HOST"} }), ""},
+		{[]string{"--except=host, remote_*"}, with(func(o *gosubst.Options) { o.Except = []string{"host", "remote_*"} }), ""},
+		{[]string{"$APP_NAME ${PORT}"}, with(func(o *gosubst.Options) { o.Format, o.Only = true, []string{"APP_NAME", "PORT"} }), ""},
+		{[]string{"-e", "APP_*"}, with(func(o *gosubst.Options) { o.Template, o.Format, o.Only = false, true, []string{"APP_*"} }), ""},
+		{[]string{"-e", "none"}, with(func(o *gosubst.Options) { o.Template, o.Format, o.Only = false, true, []string{"none"} }), ""},
+		{[]string{""}, with(func(o *gosubst.Options) { o.Format = true }), ""},
+		{[]string{"--only"}, defaults, "--only requires an argument"},
+		{[]string{"--on-bad-syntax=keep"}, with(func(o *gosubst.Options) { o.BadSyntax = gosubst.KeepBadSyntax }), ""},
+		{[]string{"--on-bad-syntax", "error"}, with(func(o *gosubst.Options) { o.BadSyntax = gosubst.RejectBadSyntax }), ""},
+		{[]string{"--on-bad-syntax", "ignore"}, defaults, "invalid syntax policy \"ignore\""},
+		{[]string{"--syntax", "at"}, with(func(o *gosubst.Options) { o.Syntax = gosubst.Syntaxes["at"] }), ""},
+		{[]string{"--syntax=nope"}, defaults, "invalid syntax \"nope\""},
+		{[]string{"--expand-depth", "3"}, with(func(o *gosubst.Options) { o.Depth = 3 }), ""},
+		{[]string{"--expand-depth=-1"}, defaults, "--expand-depth must be a number, not \"-1\""},
+		{[]string{"--escape", "yaml"}, with(func(o *gosubst.Options) { o.Escape = gosubst.EscapeYAML }), ""},
+		{[]string{"--escape=toml"}, defaults, "invalid escaping \"toml\""},
+		{[]string{"--env-file", ".env", "--env-file=.env.local"}, with(func(o *gosubst.Options) { o.EnvFiles = []string{".env", ".env.local"} }), ""},
+		{[]string{"--clean-env"}, with(func(o *gosubst.Options) { o.CleanEnv = true }), ""},
+		{[]string{"--pass-env", "APP_*,NGINX_*", "--pass-env=PATH"}, with(func(o *gosubst.Options) {
+			o.CleanEnv, o.PassEnv = true, []string{"APP_*", "NGINX_*", "PATH"}
+		}), ""},
+		{[]string{"-f", "a.yaml", "--values=b.json"}, with(func(o *gosubst.Options) { o.Values = []string{"a.yaml", "b.json"} }), ""},
+		{[]string{"-f"}, defaults, "-f requires an argument"},
+		{[]string{"--set", "a=1,b=2", "--set-string=c=3", "--set-file", "d=e"}, with(func(o *gosubst.Options) {
+			o.Set, o.SetString, o.SetFile = []string{"a=1,b=2"}, []string{"c=3"}, []string{"d=e"}
+		}), ""},
+		{[]string{"--schema", "a.json", "--schema=b.json"}, with(func(o *gosubst.Options) { o.Schemas = []string{"a.json", "b.json"} }), ""},
+		{[]string{"--key-file", "gosubst.key"}, with(func(o *gosubst.Options) { o.KeyFile = "gosubst.key" }), ""},
+		{[]string{"--secrets-dir", "/run/secrets", "--secrets-dir=/run/more"}, with(func(o *gosubst.Options) { o.SecretsDirs = []string{"/run/secrets", "/run/more"} }), ""},
+		{[]string{"--profile", "prod"}, with(func(o *gosubst.Options) { o.Profile = "prod" }), ""},
+		{[]string{"--profile=a/b"}, defaults, `invalid profile "a/b"`},
+		{[]string{"--skip-literals"}, with(func(o *gosubst.Options) { o.Literals = true }), ""},
+		{[]string{"-u", "--allow-empty"}, with(func(o *gosubst.Options) { o.Strict, o.AllowEmpty = true, true }), ""},
+		{[]string{"--debug=yes"}, defaults, "--debug doesn't allow an argument"},
+	}
+	for _, test := range tests {
+		opts, err := gosubst.ParseOptions(test.args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ParseOptions(%q) has error %v; expected %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOptions(%q) has error %q; expected nil", test.args, err)
+		}
+		if !reflect.DeepEqual(opts, test.opts) {
+			t.Errorf("ParseOptions(%q) == %+v; expected %+v", test.args, opts, test.opts)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// NOTE: the pattern operators (${VAR#pat}, ${VAR/pat/rep}, etc) use the
+//       shell's globbing rules rather than path.Match's, since in bash
+//       a "*" matches across slashes. Patterns are matched rune-wise:
+//
+//       *       any string, including the empty string
+//       ?       any single character
+//       [...]   any one of the enclosed characters, ranges (a-z), or
+//               classes ([:alpha:]); [!...] or [^...] negates
+//       \c      the literal character c
+
+// matchGlob reports whether the whole of s matches the shell pattern.
+func matchGlob(pattern, s string) bool {
+	return matchRunes([]rune(pattern), []rune(s))
+}
+
+func matchRunes(pat, str []rune) bool {
+	// Classic iterative wildcard matching: remember the last "*" seen,
+	// and on a mismatch let it swallow one more character and retry.
+	p, s := 0, 0
+	star, mark := -1, 0
+	for s < len(str) {
+		if p < len(pat) {
+			switch pat[p] {
+			case '*':
+				star, mark = p, s
+				p++
+				continue
+			case '?':
+				p++
+				s++
+				continue
+			case '[':
+				if ok, w := matchBracket(pat[p:], str[s]); w > 0 {
+					if ok {
+						p += w
+						s++
+						continue
+					}
+					break
+				}
+				// An unterminated bracket is just a "[".
+				if str[s] == '[' {
+					p++
+					s++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pat) && pat[p+1] == str[s] {
+					p += 2
+					s++
+					continue
+				}
+				// A trailing backslash is just a backslash.
+				if p+1 == len(pat) && str[s] == '\\' {
+					p++
+					s++
+					continue
+				}
+			default:
+				if pat[p] == str[s] {
+					p++
+					s++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		p = star + 1
+		mark++
+		s = mark
+	}
+	for p < len(pat) && pat[p] == '*' {
+		p++
+	}
+	return p == len(pat)
+}
+
+// matchBracket matches c against the bracket expression at the start of
+// pat, returning whether it matched and the width of the expression. A
+// width of zero means the bracket is never closed.
+func matchBracket(pat []rune, c rune) (bool, int) {
+	i := 1
+	negate := false
+	if i < len(pat) && (pat[i] == '!' || pat[i] == '^') {
+		negate = true
+		i++
+	}
+	matched := false
+	for first := true; i < len(pat); first = false {
+		if pat[i] == ']' && !first {
+			return matched != negate, i + 1
+		}
+		if pat[i] == '[' && i+1 < len(pat) && pat[i+1] == ':' {
+			if end := indexRunes(pat[i+2:], ":]"); end >= 0 {
+				if inClass(string(pat[i+2:i+2+end]), c) {
+					matched = true
+				}
+				i += end + 4
+				continue
+			}
+		}
+		lo := pat[i]
+		if lo == '\\' && i+1 < len(pat) {
+			i++
+			lo = pat[i]
+		}
+		hi := lo
+		if i+2 < len(pat) && pat[i+1] == '-' && pat[i+2] != ']' {
+			hi = pat[i+2]
+			if hi == '\\' && i+3 < len(pat) {
+				i++
+				hi = pat[i+2]
+			}
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0
+}
+
+// inClass reports whether c is in the named POSIX character class.
+func inClass(class string, c rune) bool {
+	switch class {
+	case "alnum":
+		return unicode.IsLetter(c) || unicode.IsDigit(c)
+	case "alpha":
+		return unicode.IsLetter(c)
+	case "blank":
+		return c == ' ' || c == '\t'
+	case "cntrl":
+		return unicode.IsControl(c)
+	case "digit":
+		return '0' <= c && c <= '9'
+	case "graph":
+		return unicode.IsGraphic(c) && !unicode.IsSpace(c)
+	case "lower":
+		return unicode.IsLower(c)
+	case "print":
+		return unicode.IsPrint(c)
+	case "punct":
+		return unicode.IsPunct(c) || unicode.IsSymbol(c)
+	case "space":
+		return unicode.IsSpace(c)
+	case "upper":
+		return unicode.IsUpper(c)
+	case "word":
+		return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+	case "xdigit":
+		return strings.ContainsRune("0123456789abcdefABCDEF", c)
+	}
+	return false
+}
+
+// indexRunes returns the index of the first instance of sub in rs, or
+// -1 if sub is not present.
+func indexRunes(rs []rune, sub string) int {
+	want := []rune(sub)
+	for i := 0; i+len(want) <= len(rs); i++ {
+		if string(rs[i:i+len(want)]) == sub {
+			return i
+		}
+	}
+	return -1
+}
+
+// trimGlobPrefix removes the shortest (or longest) prefix of s matching
+// the pattern, as with ${VAR#pat} (or ${VAR##pat}).
+func trimGlobPrefix(s, pattern string, longest bool) string {
+	str, pat := []rune(s), []rune(pattern)
+	for n := 0; n <= len(str); n++ {
+		i := n
+		if longest {
+			i = len(str) - n
+		}
+		if matchRunes(pat, str[:i]) {
+			return string(str[i:])
+		}
+	}
+	return s
+}
+
+// trimGlobSuffix removes the shortest (or longest) suffix of s matching
+// the pattern, as with ${VAR%pat} (or ${VAR%%pat}).
+func trimGlobSuffix(s, pattern string, longest bool) string {
+	str, pat := []rune(s), []rune(pattern)
+	for n := 0; n <= len(str); n++ {
+		i := len(str) - n
+		if longest {
+			i = n
+		}
+		if matchRunes(pat, str[i:]) {
+			return string(str[:i])
+		}
+	}
+	return s
+}
+
+// replaceGlob replaces the longest match of the pattern in s with repl,
+// as with ${VAR/pat/rep}. If all is set every match is replaced, as with
+// ${VAR//pat/rep}. An anchor of '#' or '%' only matches the pattern at
+// the start or end of s, as with ${VAR/#pat/rep} and ${VAR/%pat/rep}.
+func replaceGlob(s, pattern, repl string, all bool, anchor byte) string {
+	str, pat := []rune(s), []rune(pattern)
+	switch anchor {
+	case '#':
+		for i := len(str); i >= 0; i-- {
+			if matchRunes(pat, str[:i]) {
+				return repl + string(str[i:])
+			}
+		}
+		return s
+	case '%':
+		for i := 0; i <= len(str); i++ {
+			if matchRunes(pat, str[i:]) {
+				return string(str[:i]) + repl
+			}
+		}
+		return s
+	}
+	if len(pat) == 0 {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(str); {
+		end := -1
+		for j := len(str); j > i; j-- {
+			if matchRunes(pat, str[i:j]) {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			b.WriteRune(str[i])
+			i++
+			continue
+		}
+		b.WriteString(repl)
+		i = end
+		if !all {
+			b.WriteString(string(str[i:]))
+			return b.String()
+		}
+	}
+	return b.String()
+}
+
+// convertCase upper- (or lower-) cases the first character of s if it
+// matches the pattern, as with ${VAR^pat} (or ${VAR,pat}). If all is set
+// every matching character is converted, as with ${VAR^^pat}. An empty
+// pattern matches any character.
+func convertCase(s, pattern string, upper, all bool) string {
+	if pattern == "" {
+		pattern = "?"
+	}
+	pat := []rune(pattern)
+	str := []rune(s)
+	for i, c := range str {
+		if matchRunes(pat, []rune{c}) {
+			if upper {
+				str[i] = unicode.ToUpper(c)
+			} else {
+				str[i] = unicode.ToLower(c)
+			}
+		}
+		if !all {
+			break
+		}
+	}
+	return string(str)
+}
@@ -0,0 +1,54 @@
+package main_test
+
+import (
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+// The whole of a value matches a pattern if ${VAL##pattern} removes all
+// of it.
+var globTests = []struct {
+	pattern, value string
+	match          bool
+}{
+	{"*", "anything/at/all", true},
+	{"a*", "abc", true},
+	{"a*", "bac", false},
+	{"*c", "abc", true},
+	{"a*c", "a/b/c", true},
+	{"a?c", "abc", true},
+	{"a?c", "ac", false},
+	{"???", "日本語", true},
+	{"[abc]", "b", true},
+	{"[abc]", "d", false},
+	{"[a-c]x", "bx", true},
+	{"[!a-c]x", "bx", false},
+	{"[^a-c]x", "dx", true},
+	{"[]]", "]", true},
+	{"[!]]", "]", false},
+	{"[[:digit:]][[:alpha:]]", "1a", true},
+	{"[[:upper:]]*", "lower", false},
+	{"[[:space:]]", " ", true},
+	{"\\*", "*", true},
+	{"\\*", "a", false},
+	{"a\\", "a\\", true},
+	{"[", "[", true},
+	{"[ab", "[ab", true},
+	{"*.*.*", "v1.2.3", true},
+	{"*.*.*", "v1.2", false},
+	{"**x", "abcx", true},
+}
+
+func TestGlobPatterns(t *testing.T) {
+	for _, test := range globTests {
+		lookup := func(string) (string, bool) { return test.value, true }
+		result, err := gosubst.NewExpander(lookup).Expand("${VAL##" + test.pattern + "}")
+		if err != nil {
+			t.Errorf("pattern %q has error %q; expected nil", test.pattern, err)
+		}
+		if match := result == ""; match != test.match {
+			t.Errorf("pattern %q matching %q == %t; expected %t", test.pattern, test.value, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// NOTE: a reference may end with a pipeline of filters, as in
+//       ${NAME|lower|trunc 63}, so that simple transformations don't
+//       need the template pass. Filters are the same functions as the
+//       template has (Sprig's, and ours), and work just like they do
+//       in a template pipeline: the value is passed to each one as its
+//       last argument. Arguments are literals: quoted strings, numbers,
+//       true and false, or else bare words, which are taken as strings.
+//       A "|" that isn't followed by the name of a filter is just a "|",
+//       and any "|" can be escaped as "\|".
+//
+//       The filters that reach outside of the value (to run commands,
+//       read files, look at the environment or the network) are only
+//       allowed if the Expander has SystemFilters set, which the command
+//       line does; otherwise using one is an error.
+
+// pipeFuncs are the functions filters may call.
+var pipeFuncs = func() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	for name, fn := range FuncMap() {
+		funcs[name] = fn
+	}
+	return funcs
+}()
+
+// systemFilters are the filters that need SystemFilters.
+var systemFilters = map[string]bool{
+	"sh":            true,
+	"requiredEnvs":  true,
+	"requiredFiles": true,
+	"env":           true,
+	"expandenv":     true,
+	"getHostByName": true,
+}
+
+// pipeCmd is a single filter in a pipeline, eg "trunc 63".
+type pipeCmd struct {
+	name string
+	fn   reflect.Value
+	args []reflect.Value
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// parsePipeline parses the filters after the first "|" of a reference.
+func parsePipeline(s string) ([]pipeCmd, error) {
+	var cmds []pipeCmd
+	for _, text := range splitQuoted(s, '|') {
+		words := splitQuoted(strings.TrimSpace(text), ' ')
+		if len(words) == 0 || words[0] == "" {
+			return nil, errors.New("empty filter")
+		}
+		cmd := pipeCmd{name: words[0]}
+		fn, ok := pipeFuncs[cmd.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", cmd.name)
+		}
+		cmd.fn = reflect.ValueOf(fn)
+		for _, word := range words[1:] {
+			if word == "" {
+				continue // between repeated spaces
+			}
+			arg, err := parseLiteral(word)
+			if err != nil {
+				return nil, fmt.Errorf("filter %s: %s", cmd.name, err)
+			}
+			cmd.args = append(cmd.args, reflect.ValueOf(arg))
+		}
+
+		// The value is the last argument.
+		typ, n := cmd.fn.Type(), len(cmd.args)+1
+		if typ.IsVariadic() && n < typ.NumIn()-1 || !typ.IsVariadic() && n != typ.NumIn() {
+			return nil, fmt.Errorf("filter %s: wrong number of arguments", cmd.name)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// startsFilter reports whether s starts with the name of a filter.
+func startsFilter(s string) bool {
+	s = strings.TrimLeft(s, " ")
+	if end := strings.IndexAny(s, " |"); end >= 0 {
+		s = s[:end]
+	}
+	_, ok := pipeFuncs[s]
+	return ok
+}
+
+// splitQuoted splits s around sep, except where it's quoted (with "...",
+// '...' or `...`) or escaped with a backslash.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseLiteral parses a filter argument.
+func parseLiteral(word string) (interface{}, error) {
+	switch word[0] {
+	case '"', '`':
+		return strconv.Unquote(word)
+	case '\'':
+		if len(word) < 2 || word[len(word)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string %s", word)
+		}
+		return word[1 : len(word)-1], nil
+	}
+	if n, err := strconv.Atoi(word); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return f, nil
+	}
+	if b, err := strconv.ParseBool(word); err == nil && (word == "true" || word == "false") {
+		return b, nil
+	}
+	return word, nil
+}
+
+// runPipeline passes val through the filters, returning the result as
+// a string.
+func runPipeline(cmds []pipeCmd, val string) (string, error) {
+	v := reflect.ValueOf(val)
+	for _, cmd := range cmds {
+		var err error
+		if v, err = cmd.call(v); err != nil {
+			return "", fmt.Errorf("filter %s: %s", cmd.name, err)
+		}
+	}
+	if !v.IsValid() {
+		return "", nil
+	}
+	return fmt.Sprint(v.Interface()), nil
+}
+
+// call calls the filter's function with its arguments, and then val.
+// As in a template, a panic in the function is returned as an error.
+func (cmd pipeCmd) call(val reflect.Value) (result reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	typ := cmd.fn.Type()
+	args := append(cmd.args[:len(cmd.args):len(cmd.args)], val)
+	for i, arg := range args {
+		var param reflect.Type
+		if typ.IsVariadic() && i >= typ.NumIn()-1 {
+			param = typ.In(typ.NumIn() - 1).Elem()
+		} else {
+			param = typ.In(i)
+		}
+		if args[i], err = convertArg(arg, param); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+
+	out := cmd.fn.Call(args)
+	if len(out) == 2 && out[1].Type() == errorType && !out[1].IsNil() {
+		return reflect.Value{}, out[1].Interface().(error)
+	}
+	if len(out) == 0 {
+		return reflect.Value{}, nil
+	}
+	result = out[0]
+	if result.Kind() == reflect.Interface {
+		result = result.Elem()
+	}
+	return result, nil
+}
+
+// convertArg converts arg to the type of a function's parameter: any
+// number converts to any other kind of number, and anything at all to a
+// string.
+func convertArg(arg reflect.Value, param reflect.Type) (reflect.Value, error) {
+	switch {
+	case !arg.IsValid():
+		return reflect.Zero(param), nil
+	case arg.Type().AssignableTo(param):
+		return arg, nil
+	case isNumber(arg.Kind()) && isNumber(param.Kind()):
+		return arg.Convert(param), nil
+	case param.Kind() == reflect.String:
+		return reflect.ValueOf(fmt.Sprint(arg.Interface())).Convert(param), nil
+	}
+	return reflect.Value{}, fmt.Errorf("wrong type for value; expected %s; got %s", param, arg.Type())
+}
+
+// isNumber reports whether the kind is a number.
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
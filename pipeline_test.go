@@ -0,0 +1,101 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+func testPipelineEnv(s string) (string, bool) {
+	val, ok := map[string]string{
+		"NAME":  "My-Service",
+		"LONG":  strings.Repeat("x", 70),
+		"CERT":  "-----BEGIN-----",
+		"REF":   "NAME",
+		"EMPTY": "",
+		"PORT":  "8080",
+		"CSV":   "a,b,c",
+	}[s]
+	return val, ok
+}
+
+var pipelineTests = []struct {
+	in, out string
+}{
+	{"${NAME|lower}", "my-service"},
+	{"${NAME | upper | quote}", `"MY-SERVICE"`},
+	{"${LONG|trunc 63}", strings.Repeat("x", 63)},
+	{"${NAME|lower|trunc 2}", "my"},
+	{"${CERT|b64enc}", "LS0tLS1CRUdJTi0tLS0t"},
+	{"${CERT|b64enc|b64dec}", "-----BEGIN-----"},
+	{`${NAME|replace "-" " "}`, "My Service"},
+	{`${NAME|replace '-' "|"}`, "My|Service"},
+	{"${NAME|replace - _}", "My_Service"},
+	{`${CSV|splitList ","|join "+"}`, "a+b+c"},
+	{"${PORT|add 1}", "8081"},
+	{"${PORT|atoi|mul 2}", "16160"},
+	{"${EMPTY|default foo}", "foo"},
+	{"${UNSET:-Foo|lower}", "foo"},
+	{"${UNSET:-${NAME}|lower}", "my-service"},
+	{"${UNSET:-a|b}", "a|b"},
+	{`${UNSET:-a\|lower}`, "a|lower"},
+	{"${!REF|lower}", "my-service"},
+	{"${NAME:3|upper}", "SERVICE"},
+	{"${NAME/-/|}", "My|Service"},
+	{"${#NAME|add 1}", "11"},
+	{"${NAME|lower} and ${NAME}", "my-service and My-Service"},
+}
+
+func TestExpanderPipeline(t *testing.T) {
+	e := gosubst.NewExpander(testPipelineEnv)
+	for _, test := range pipelineTests {
+		result, err := e.Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+		checkStream(t, e, test.in)
+	}
+}
+
+func TestExpanderPipelineErrors(t *testing.T) {
+	e := gosubst.NewExpander(testPipelineEnv)
+	e.OnBadSyntax = gosubst.RejectBadSyntax
+	badSyntax := []struct {
+		in, reason string
+	}{
+		{"${NAME|lower|}", "empty filter"},
+		{"${NAME|lower|nope}", `unknown filter "nope"`},
+		{"${NAME|trunc}", "filter trunc: wrong number of arguments"},
+		{"${NAME|lower 1}", "filter lower: wrong number of arguments"},
+		{`${NAME|replace "a}`, `filter replace: invalid syntax`},
+	}
+	for _, test := range badSyntax {
+		_, err := e.Expand(test.in)
+		syntaxErr, ok := err.(*gosubst.SyntaxError)
+		if !ok || len(syntaxErr.Refs) != 1 || syntaxErr.Refs[0].Reason != test.reason {
+			t.Errorf("Expander.Expand(%q) has error %v; expected bad syntax %q", test.in, err, test.reason)
+		}
+	}
+
+	for _, in := range []string{"${NAME|mustFirst}", "${NAME|trunc x}", "${NAME|fail}", "${NAME|repeat -1}"} {
+		if _, err := e.Expand(in); err == nil || !strings.HasPrefix(err.Error(), in+": filter ") {
+			t.Errorf("Expander.Expand(%q) has error %v; expected a filter error", in, err)
+		}
+	}
+
+	// Filters that reach outside of the value need SystemFilters.
+	e = gosubst.NewExpander(testPipelineEnv)
+	for _, in := range []string{"${NAME|sh}", "${UNSET:-touch nope|sh}", "${NAME|requiredFiles}", "${NAME|env}", "${NAME|lower|expandenv}"} {
+		if _, err := e.Expand(in); err == nil || !strings.HasPrefix(err.Error(), in+": filter ") || !strings.HasSuffix(err.Error(), "isn't allowed") {
+			t.Errorf("Expander.Expand(%q) has error %v; expected the filter isn't allowed", in, err)
+		}
+	}
+	e.SystemFilters = true
+	if result, err := e.Expand("${UNSET:-echo hi|sh}"); err != nil || result != "hi\n" {
+		t.Errorf("Expander.Expand() with SystemFilters == %q, %v; expected %q", result, err, "hi\n")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// NOTE: a profile (eg --profile prod) picks the files for an environment
+//       by convention, so that pipelines don't each assemble their own
+//       set of flags. In order, lowest precedence first:
+//
+//       values.yaml, values.prod.yaml, then any -f files     => .Values
+//       .env, .env.prod, then any --env-file files           => env vars
+//
+//       The files without the profile's name are shared by all profiles
+//       and are optional; at least one of the profile's own files must
+//       be there, so that a misspelt profile isn't quietly the defaults.
+//       --set and the real environment still win over all of them.
+
+// ProfileFiles returns the values files and dotenv files (that exist,
+// through FsBackend) for the named profile, in the order they're loaded.
+func ProfileFiles(profile string) ([]string, []string, error) {
+	exists := func(path string) bool {
+		stat, err := FsBackend.Stat(path)
+		return err == nil && !stat.IsDir()
+	}
+	var values, envFiles []string
+	for _, path := range []string{"values.yaml", "values." + profile + ".yaml"} {
+		if exists(path) {
+			values = append(values, path)
+		}
+	}
+	for _, path := range []string{".env", ".env." + profile} {
+		if exists(path) {
+			envFiles = append(envFiles, path)
+		}
+	}
+	if !exists("values."+profile+".yaml") && !exists(".env."+profile) {
+		return nil, nil, fmt.Errorf("profile %q has neither values.%[1]s.yaml nor .env.%[1]s", profile)
+	}
+	return values, envFiles, nil
+}
+
+// ApplyProfile puts the files of opts' profile (if it has one) before
+// the values files and dotenv files given, so that those given override
+// them.
+func (opts *Options) ApplyProfile() error {
+	if opts.Profile == "" {
+		return nil
+	}
+	values, envFiles, err := ProfileFiles(opts.Profile)
+	if err != nil {
+		return err
+	}
+	opts.Values = append(values, opts.Values...)
+	opts.EnvFiles = append(envFiles, opts.EnvFiles...)
+	return nil
+}
+
+// validProfile reports whether a profile's name can be part of a file's
+// name, without going anywhere else.
+func validProfile(profile string) bool {
+	if profile == "" || profile == "." || profile == ".." {
+		return false
+	}
+	for _, c := range profile {
+		if c == '/' || c == os.PathSeparator {
+			return false
+		}
+	}
+	return true
+}
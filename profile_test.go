@@ -0,0 +1,75 @@
+package main_test
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/hews/gosubst/internal/testutils"
+	"github.com/spf13/afero"
+)
+
+func TestProfile(t *testing.T) {
+	resetEnvirnonment := testutils.ClearEnvironment(t)
+	defer resetEnvirnonment()
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "values.yaml", []byte("replicas: 1\nimage: {tag: latest}\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "values.prod.yaml", []byte("replicas: 3\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "ci.yaml", []byte("image: {tag: abc123}\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, ".env", []byte("LOG_LEVEL=debug\nHOST=localhost\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, ".env.prod", []byte("LOG_LEVEL=warn\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, ".env.staging", []byte("HOST=staging\n"), 0644)
+
+	tests := []struct {
+		args             []string
+		values, envFiles []string
+		err              string
+	}{
+		{[]string{}, nil, nil, ""},
+		{[]string{"--profile", "prod"}, []string{"values.yaml", "values.prod.yaml"}, []string{".env", ".env.prod"}, ""},
+		{[]string{"--profile=prod", "-f", "ci.yaml", "--env-file", ".env.local"}, []string{"values.yaml", "values.prod.yaml", "ci.yaml"}, []string{".env", ".env.prod", ".env.local"}, ""},
+		{[]string{"--profile=staging"}, []string{"values.yaml"}, []string{".env", ".env.staging"}, ""},
+		{[]string{"--profile=prdo"}, nil, nil, `profile "prdo" has neither values.prdo.yaml nor .env.prdo`},
+		{[]string{"--profile=../prod"}, nil, nil, `invalid profile "../prod"`},
+		{[]string{"--profile="}, nil, nil, `invalid profile ""`},
+	}
+	for _, test := range tests {
+		opts, err := gosubst.ParseOptions(test.args)
+		if err == nil {
+			err = opts.ApplyProfile()
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ApplyProfile() with %q has error %v; expected %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ApplyProfile() with %q has error %q; expected nil", test.args, err)
+		}
+		if !reflect.DeepEqual(opts.Values, test.values) || !reflect.DeepEqual(opts.EnvFiles, test.envFiles) {
+			t.Errorf("ApplyProfile() with %q gives %q and %q; expected %q and %q", test.args, opts.Values, opts.EnvFiles, test.values, test.envFiles)
+		}
+	}
+
+	opts, _ := gosubst.ParseOptions([]string{"--profile", "prod", "-f", "ci.yaml", "--set", "replicas=5"})
+	if err := opts.ApplyProfile(); err != nil {
+		t.Fatalf("ApplyProfile() has error %q; expected nil", err)
+	}
+	os.Setenv("HOST", "example.com")
+	if err := gosubst.LoadEnvFiles(opts.EnvFiles...); err != nil {
+		t.Fatalf("LoadEnvFiles() has error %q; expected nil", err)
+	}
+	input := "${LOG_LEVEL} ${HOST} {{ .Profile }} x{{ .Values.replicas }} {{ .Values.image.tag }}"
+	output, err := gosubst.Render(input, opts)
+	if expected := "warn example.com prod x5 abc123"; err != nil || output != expected {
+		t.Errorf("Render(%q) == %q, %v; expected %q", input, output, err, expected)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// NOTE: a reference can name a scheme, as in ${file:/run/secrets/db},
+//       to have its value come from somewhere other than a variable.
+//       The argument (everything after the colon, up to any filters) is
+//       expanded first, so ${file:/run/secrets/${NAME}} works. Out of the
+//       box there are:
+//
+//       ${env:NAME}     just ${NAME}, and takes the same operators
+//       ${file:PATH}    the contents of the file at PATH (through FsBackend)
+//       ${cmd:COMMAND}  the output of "sh -c COMMAND", less any trailing
+//                       newlines, as with $(...) in the shell
+//
+//       Schemes are opt in: an Expander only resolves those in its
+//       Resolvers, which the command line fills in with every registered
+//       one. With SystemFilters (see pipeline.go) off too, as it is by
+//       default, a library user (or dotenv file, or --variables) that
+//       asks for neither can't be made to read files or run commands.
+//       Library users can add their own with RegisterResolver. Since
+//       ${NAME:offset} and ${NAME:-word} look a lot like ${scheme:arg}, a
+//       reference only names a scheme if that scheme is registered and
+//       its argument doesn't look like one of those operands.
+
+// Resolver resolves the references for a scheme, like ${file:/path}.
+type Resolver interface {
+	// Resolve returns the value of a reference, given its (expanded)
+	// argument.
+	Resolve(arg string) (string, error)
+}
+
+// ResolverFunc adapts an ordinary function to a Resolver.
+type ResolverFunc func(arg string) (string, error)
+
+// Resolve calls f(arg).
+func (f ResolverFunc) Resolve(arg string) (string, error) {
+	return f(arg)
+}
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]Resolver{
+		"file": ResolverFunc(resolveFile),
+		"cmd":  ResolverFunc(resolveCmd),
+	}
+)
+
+// RegisterResolver makes r resolve references of the form ${scheme:arg},
+// replacing any Resolver already registered for the scheme. It panics if
+// scheme isn't a valid name, or is "env" (which is built in).
+func RegisterResolver(scheme string, r Resolver) {
+	if !isName(scheme) || scheme == "env" {
+		panic(fmt.Sprintf("gosubst: can't register a resolver for %q", scheme))
+	}
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	if r == nil {
+		delete(resolvers, scheme)
+		return
+	}
+	resolvers[scheme] = r
+}
+
+// DefaultResolvers returns (a copy of) the registered Resolvers, by
+// scheme, for an Expander's Resolvers.
+func DefaultResolvers() map[string]Resolver {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	copied := make(map[string]Resolver, len(resolvers))
+	for scheme, r := range resolvers {
+		copied[scheme] = r
+	}
+	return copied
+}
+
+// registered reports whether a Resolver is registered for the scheme.
+func registered(scheme string) bool {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	return resolvers[scheme] != nil
+}
+
+// splitScheme splits the body of a reference like ${scheme:arg} into its
+// scheme and argument, if the scheme is one of resolvers, or registered
+// (so that using one that isn't allowed is an error, rather than taken
+// for a variable with an offset).
+func splitScheme(body string, resolvers map[string]Resolver) (string, string, bool) {
+	colon := strings.IndexByte(body, ':')
+	if colon < 0 || colon == len(body)-1 {
+		return "", "", false
+	}
+	scheme, arg := body[:colon], body[colon+1:]
+	// Leave ${VAR:-word}, ${VAR:offset} and so on alone.
+	if strings.IndexByte("-=+?( 0123456789", arg[0]) >= 0 || !isName(scheme) || resolvers[scheme] == nil && !registered(scheme) {
+		return "", "", false
+	}
+	return scheme, arg, true
+}
+
+// resolveFile returns the contents of the file at path.
+func resolveFile(path string) (string, error) {
+	data, err := afero.ReadFile(FsBackend, path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// resolveCmd returns the output of the shell command, without any
+// trailing newlines. If it fails, the error includes what it wrote to
+// STDERR.
+func resolveCmd(cmdstr string) (string, error) {
+	out, err := Sh(cmdstr)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out, "\n"), nil
+}
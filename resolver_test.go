@@ -0,0 +1,131 @@
+package main_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/spf13/afero"
+)
+
+func TestExpanderResolvers(t *testing.T) {
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/db", []byte("hunter2\n"), 0600)
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/full", []byte("all of it"), 0600)
+
+	gosubst.RegisterResolver("upper", gosubst.ResolverFunc(func(arg string) (string, error) {
+		if arg == "fail" {
+			return "", errors.New("failed")
+		}
+		return strings.ToUpper(arg), nil
+	}))
+	defer gosubst.RegisterResolver("upper", nil)
+
+	tests := []struct {
+		in, out string
+	}{
+		{"${env:FULL}", "full"},
+		{"${env:UNSET:-default} ${env:FULL:0:2}", "default fu"},
+		{"${file:/run/secrets/db}", "hunter2\n"},
+		{"${file:/run/secrets/db|trim}", "hunter2"},
+		{"${file:/run/secrets/${SECRET}}", "all of it"},
+		{"${cmd:echo hello; echo}", "hello"},
+		{"${cmd:printf '%s' \"${FULL}\"|upper}", "FULL"},
+		{"${upper:some ${FULL} text}", "SOME FULL TEXT"},
+		{"${FULL:-x} ${UNSET:+x} ${FULL:2}", "full  ll"},
+	}
+	e := gosubst.NewExpander(func(name string) (string, bool) {
+		if name == "SECRET" {
+			return "full", true
+		}
+		return testLookupEnv(name)
+	})
+	e.Resolvers = gosubst.DefaultResolvers()
+	for _, test := range tests {
+		result, err := e.Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) has error %q; expected nil", test.in, err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) == %q; expected %q", test.in, result, test.out)
+		}
+		checkStream(t, e, test.in)
+	}
+
+	errs := []struct {
+		in, err string
+	}{
+		{"${file:/run/secrets/nope}", "${file:/run/secrets/nope}: open /run/secrets/nope: file does not exist"},
+		{"${cmd:echo oops >&2; exit 3}", "${cmd:echo oops >&2; exit 3}: exit status 3: oops"},
+		{"${upper:fail}", "${upper:fail}: failed"},
+		{"${nope:x}", `${nope}: "x": invalid offset`},
+	}
+	for _, test := range errs {
+		if _, err := e.Expand(test.in); err == nil || err.Error() != test.err {
+			t.Errorf("Expander.Expand(%q) has error %v; expected %q", test.in, err, test.err)
+		}
+	}
+
+	// Only the schemes that are allowed are resolved.
+	e.Allow = func(name string) bool { return strings.HasPrefix(name, "upper:") }
+	if result, _ := e.Expand("${upper:x} ${file:/run/secrets/db}"); result != "X ${file:/run/secrets/db}" {
+		t.Errorf("Expander.Expand() with Allow == %q; expected only upper: to be resolved", result)
+	}
+
+	// Without any Resolvers, schemes aren't allowed.
+	e = gosubst.NewExpander(testLookupEnv)
+	if _, err := e.Expand("${cmd:echo hello}"); err == nil || err.Error() != `${cmd:echo hello}: scheme "cmd" isn't allowed here` {
+		t.Errorf("Expander.Expand() without Resolvers has error %v; expected the scheme isn't allowed", err)
+	}
+	if result, _ := e.Expand("${file:-default}"); result != "default" {
+		t.Errorf("Expander.Expand() without Resolvers == %q; expected %q", result, "default")
+	}
+}
+
+func TestExpanderUntrusted(t *testing.T) {
+	// By default, an Expander can't be made to read files or run commands,
+	// by schemes, filters, or anything nested in them.
+	dir, err := ioutil.TempDir("", "gosubst-untrusted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	touch := "touch " + filepath.Join(dir, "ran")
+
+	resolved := false
+	gosubst.RegisterResolver("probe", gosubst.ResolverFunc(func(arg string) (string, error) {
+		resolved = true
+		return arg, nil
+	}))
+	defer gosubst.RegisterResolver("probe", nil)
+
+	e := gosubst.NewExpander(testLookupEnv)
+	for _, in := range []string{
+		"${probe:x}",
+		"${cmd:" + touch + "}",
+		"${file:/etc/passwd}",
+		"${UNSET:-" + touch + "|sh}",
+		"${UNSET:-/etc/passwd|requiredFiles}",
+		"${FULL:-${probe:x}}",
+		"${X_${cmd:" + touch + "}}",
+		"${UNSET:-$(" + touch + ")}",
+	} {
+		e.Expand(in)
+		checkStream(t, e, in)
+	}
+	if resolved {
+		t.Errorf("Expander.Expand() resolved a scheme; expected it not to")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Errorf("Expander.Expand() ran a command; expected it not to")
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+)
+
+// NOTE: this is the part of JSON Schema (draft 7) that's worth having
+//       for values, as Helm uses it for values.schema.json:
+//
+//       type, enum, const           any value
+//       properties, required,       objects
+//         additionalProperties,
+//         patternProperties,
+//         minProperties,
+//         maxProperties
+//       items, minItems, maxItems,  arrays (items may be a list of
+//         uniqueItems                 schemas, one per item)
+//       minimum, maximum,           numbers
+//         exclusiveMinimum,
+//         exclusiveMaximum,
+//         multipleOf
+//       minLength, maxLength,       strings
+//         pattern
+//       allOf, anyOf, oneOf, not    combining schemas
+//       $ref                        "#", or a JSON pointer into the same
+//                                   schema, eg "#/definitions/port"
+//
+//       Anything else (title, description, default, format, ...) is
+//       ignored, as the spec allows.
+
+// Schema is a JSON Schema that values can be validated against.
+type Schema struct {
+	Name string      // what it's called in errors, eg its path
+	root interface{} // the parsed schema: a bool, or a map of keywords
+}
+
+// Violation is a part of a value that doesn't match a Schema.
+type Violation struct {
+	Path    string // a JSON pointer to it, eg "/image/tag" ("" is the whole value)
+	Message string // what's wrong with it
+}
+
+// SchemaError lists every Violation of a Schema found in a value.
+type SchemaError struct {
+	Schema     string
+	Violations []Violation
+}
+
+func (e *SchemaError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		path := v.Path
+		if path == "" {
+			path = "(root)"
+		}
+		msgs[i] = fmt.Sprintf("%s: %s", path, v.Message)
+	}
+	if len(msgs) == 1 {
+		return fmt.Sprintf("values don't match %s: %s", e.Schema, msgs[0])
+	}
+	return fmt.Sprintf("values don't match %s, with %d violations:\n  %s", e.Schema, len(msgs), strings.Join(msgs, "\n  "))
+}
+
+// LoadSchema reads and parses the JSON Schema at path (through
+// FsBackend).
+func LoadSchema(path string) (*Schema, error) {
+	data, err := afero.ReadFile(FsBackend, path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ParseSchema(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return schema, nil
+}
+
+// ParseSchema parses a JSON Schema called name.
+func ParseSchema(name string, data []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	schema := &Schema{Name: name, root: root}
+	if err := schema.check(root, ""); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// check walks a (sub)schema at the given pointer, making sure that it's
+// a schema and that all of its $refs can be followed.
+func (s *Schema) check(node interface{}, at string) error {
+	switch node := node.(type) {
+	case bool:
+		return nil
+	case map[string]interface{}:
+		if ref, ok := node["$ref"]; ok {
+			str, _ := ref.(string)
+			if _, err := s.resolve(str); err != nil {
+				return fmt.Errorf("%s/$ref: %s", at, err)
+			}
+		}
+		for _, key := range sortedKeys(node) {
+			val, path := node[key], at+"/"+escapePointer(key)
+			switch key {
+			case "items", "additionalProperties", "not":
+				if list, ok := val.([]interface{}); ok && key == "items" {
+					for i, item := range list {
+						if err := s.check(item, path+"/"+strconv.Itoa(i)); err != nil {
+							return err
+						}
+					}
+				} else if err := s.check(val, path); err != nil {
+					return err
+				}
+			case "allOf", "anyOf", "oneOf":
+				list, ok := val.([]interface{})
+				if !ok || len(list) == 0 {
+					return fmt.Errorf("%s: must be a list of schemas", path)
+				}
+				for i, item := range list {
+					if err := s.check(item, path+"/"+strconv.Itoa(i)); err != nil {
+						return err
+					}
+				}
+			case "properties", "patternProperties", "definitions", "$defs":
+				props, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s: must be a map of schemas", path)
+				}
+				for _, name := range sortedKeys(props) {
+					if key == "patternProperties" {
+						if _, err := regexp.Compile(name); err != nil {
+							return fmt.Errorf("%s: %s", path, err)
+						}
+					}
+					if err := s.check(props[name], path+"/"+escapePointer(name)); err != nil {
+						return err
+					}
+				}
+			case "type":
+				types := toStrings(val)
+				if len(types) == 0 {
+					return fmt.Errorf("%s: must be a type or a list of types", path)
+				}
+				for _, name := range types {
+					if !jsonTypes[name] {
+						return fmt.Errorf("%s: invalid type %q", path, name)
+					}
+				}
+			case "pattern":
+				str, _ := val.(string)
+				if _, err := regexp.Compile(str); err != nil {
+					return fmt.Errorf("%s: %s", path, err)
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: a schema must be an object or a boolean", at)
+	}
+}
+
+// resolve follows a $ref, which must point into the same schema.
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only references within the schema (\"#/...\") are supported, not %q", ref)
+	}
+	node := s.root
+	if ref == "#" {
+		return node, nil
+	}
+	for _, key := range strings.Split(ref[2:], "/") {
+		key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+		switch n := node.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if node, ok = n[key]; !ok {
+				return nil, fmt.Errorf("%q doesn't exist", ref)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("%q doesn't exist", ref)
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%q doesn't exist", ref)
+		}
+	}
+	return node, nil
+}
+
+// Validate reports every part of val that doesn't match the schema, as a
+// *SchemaError.
+func (s *Schema) Validate(val interface{}) error {
+	vs := s.validate(s.root, val, "", 0)
+	if len(vs) > 0 {
+		return &SchemaError{Schema: s.Name, Violations: vs}
+	}
+	return nil
+}
+
+// maxRefDepth is how deep $refs can go before a schema's taken to refer
+// to itself forever.
+const maxRefDepth = 64
+
+// validate returns the violations of the (sub)schema node by val, which
+// is at the JSON pointer path.
+func (s *Schema) validate(node, val interface{}, path string, depth int) []Violation {
+	var vs []Violation
+	fail := func(format string, args ...interface{}) {
+		vs = append(vs, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	kw, ok := node.(map[string]interface{})
+	if !ok {
+		if node == false {
+			fail("isn't allowed")
+		}
+		return vs
+	}
+
+	if ref, ok := kw["$ref"].(string); ok {
+		if depth >= maxRefDepth {
+			fail("$ref %q goes too deep", ref)
+			return vs
+		}
+		target, _ := s.resolve(ref) // checked by ParseSchema
+		// In draft 7, $ref overrides any keywords next to it.
+		return s.validate(target, val, path, depth+1)
+	}
+
+	if t, ok := kw["type"]; ok {
+		types := toStrings(t)
+		matched := false
+		for _, name := range types {
+			matched = matched || isType(val, name)
+		}
+		if !matched {
+			fail("must be %s, not %s", joinOr(withArticles(types)), withArticle(jsonType(val)))
+			return vs // the rest would only pile on
+		}
+	}
+	if enum, ok := kw["enum"].([]interface{}); ok {
+		found := false
+		for _, item := range enum {
+			found = found || jsonEqual(val, item)
+		}
+		if !found {
+			items := make([]string, len(enum))
+			for i, item := range enum {
+				items[i] = jsonString(item)
+			}
+			fail("must be one of %s, not %s", strings.Join(items, ", "), jsonString(val))
+		}
+	}
+	if c, ok := kw["const"]; ok && !jsonEqual(val, c) {
+		fail("must be %s, not %s", jsonString(c), jsonString(val))
+	}
+
+	switch val := val.(type) {
+	case map[string]interface{}:
+		vs = append(vs, s.validateObject(kw, val, path, depth)...)
+	case []interface{}:
+		vs = append(vs, s.validateArray(kw, val, path, depth)...)
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if min, ok := kw["minLength"].(float64); ok && n < min {
+			fail("must be at least %v characters long, not %v", min, n)
+		}
+		if max, ok := kw["maxLength"].(float64); ok && n > max {
+			fail("must be at most %v characters long, not %v", max, n)
+		}
+		if pattern, ok := kw["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(val) {
+			fail("must match the pattern %q", pattern)
+		}
+	default:
+		if n, ok := toNumber(val); ok {
+			if min, ok := kw["minimum"].(float64); ok && n < min {
+				fail("must be at least %v, not %v", min, n)
+			}
+			if max, ok := kw["maximum"].(float64); ok && n > max {
+				fail("must be at most %v, not %v", max, n)
+			}
+			if min, ok := kw["exclusiveMinimum"].(float64); ok && n <= min {
+				fail("must be more than %v, not %v", min, n)
+			}
+			if max, ok := kw["exclusiveMaximum"].(float64); ok && n >= max {
+				fail("must be less than %v, not %v", max, n)
+			}
+			if m, ok := kw["multipleOf"].(float64); ok && m > 0 {
+				if q := n / m; q != math.Trunc(q) {
+					fail("must be a multiple of %v, not %v", m, n)
+				}
+			}
+		}
+	}
+
+	if all, ok := kw["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			vs = append(vs, s.validate(sub, val, path, depth)...)
+		}
+	}
+	if anyOf, ok := kw["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(s.validate(sub, val, path, depth)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one of the schemas in anyOf")
+		}
+	}
+	if one, ok := kw["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range one {
+			if len(s.validate(sub, val, path, depth)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("must match exactly one of the schemas in oneOf, not %d", matches)
+		}
+	}
+	if not, ok := kw["not"]; ok && len(s.validate(not, val, path, depth)) == 0 {
+		fail("mustn't match the schema in not")
+	}
+	return vs
+}
+
+// validateObject applies the keywords for objects.
+func (s *Schema) validateObject(kw map[string]interface{}, val map[string]interface{}, path string, depth int) []Violation {
+	var vs []Violation
+	n := float64(len(val))
+	if min, ok := kw["minProperties"].(float64); ok && n < min {
+		vs = append(vs, Violation{path, fmt.Sprintf("must have at least %v properties, not %v", min, n)})
+	}
+	if max, ok := kw["maxProperties"].(float64); ok && n > max {
+		vs = append(vs, Violation{path, fmt.Sprintf("must have at most %v properties, not %v", max, n)})
+	}
+	if required, ok := kw["required"].([]interface{}); ok {
+		for _, name := range toStrings(required) {
+			if _, ok := val[name]; !ok {
+				vs = append(vs, Violation{path + "/" + escapePointer(name), "is required"})
+			}
+		}
+	}
+
+	props, _ := kw["properties"].(map[string]interface{})
+	patterns, _ := kw["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := kw["additionalProperties"]
+	for _, name := range sortedKeys(val) {
+		at := path + "/" + escapePointer(name)
+		matched := false
+		if sub, ok := props[name]; ok {
+			matched = true
+			vs = append(vs, s.validate(sub, val[name], at, depth)...)
+		}
+		for _, pattern := range sortedKeys(patterns) {
+			if regexp.MustCompile(pattern).MatchString(name) {
+				matched = true
+				vs = append(vs, s.validate(patterns[pattern], val[name], at, depth)...)
+			}
+		}
+		if !matched && hasAdditional {
+			if additional == false {
+				vs = append(vs, Violation{at, "isn't an allowed property"})
+			} else {
+				vs = append(vs, s.validate(additional, val[name], at, depth)...)
+			}
+		}
+	}
+	return vs
+}
+
+// validateArray applies the keywords for arrays.
+func (s *Schema) validateArray(kw map[string]interface{}, val []interface{}, path string, depth int) []Violation {
+	var vs []Violation
+	n := float64(len(val))
+	if min, ok := kw["minItems"].(float64); ok && n < min {
+		vs = append(vs, Violation{path, fmt.Sprintf("must have at least %v items, not %v", min, n)})
+	}
+	if max, ok := kw["maxItems"].(float64); ok && n > max {
+		vs = append(vs, Violation{path, fmt.Sprintf("must have at most %v items, not %v", max, n)})
+	}
+	if unique, _ := kw["uniqueItems"].(bool); unique {
+	dupes:
+		for i := range val {
+			for j := 0; j < i; j++ {
+				if jsonEqual(val[i], val[j]) {
+					vs = append(vs, Violation{path, fmt.Sprintf("must have unique items, but %d and %d are the same", j, i)})
+					break dupes
+				}
+			}
+		}
+	}
+	for i, item := range val {
+		var sub interface{}
+		switch items := kw["items"].(type) {
+		case []interface{}:
+			if i >= len(items) {
+				continue
+			}
+			sub = items[i]
+		case nil:
+			continue
+		default:
+			sub = items
+		}
+		vs = append(vs, s.validate(sub, item, path+"/"+strconv.Itoa(i), depth)...)
+	}
+	return vs
+}
+
+// escapePointer escapes a key for a JSON pointer.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// sortedKeys returns the keys of m, sorted, so that violations are
+// reported in the same order every time.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// toStrings returns the strings of a keyword that's a string or a list
+// of them (eg "type").
+func toStrings(val interface{}) []string {
+	if str, ok := val.(string); ok {
+		return []string{str}
+	}
+	var strs []string
+	list, _ := val.([]interface{})
+	for _, item := range list {
+		if str, ok := item.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// toNumber returns val as a float64, if it's any kind of number (values
+// files give ints, --set gives int64s, and JSON gives float64s).
+func toNumber(val interface{}) (float64, bool) {
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// jsonTypes are the types that "type" can name.
+var jsonTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// jsonType returns the JSON type of val.
+func jsonType(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	if n, ok := toNumber(val); ok {
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// isType reports whether val is of the named JSON type.
+func isType(val interface{}, name string) bool {
+	t := jsonType(val)
+	return t == name || (name == "number" && t == "integer")
+}
+
+// jsonEqual reports whether a and b are the same JSON value, whatever Go
+// types their numbers are.
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// jsonString returns val as JSON, for errors.
+func jsonString(val interface{}) string {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(data)
+}
+
+// withArticle returns a type's name with "a" or "an" before it.
+func withArticle(name string) string {
+	if name == "null" {
+		return name
+	}
+	if strings.IndexByte("aeiou", name[0]) >= 0 {
+		return "an " + name
+	}
+	return "a " + name
+}
+
+// withArticles is withArticle for a list of names.
+func withArticles(names []string) []string {
+	with := make([]string, len(names))
+	for i, name := range names {
+		with[i] = withArticle(name)
+	}
+	return with
+}
+
+// joinOr joins a list as in English, eg "a, b or c".
+func joinOr(items []string) string {
+	if len(items) < 2 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " or " + items[len(items)-1]
+}
+
+// SchemaPath returns the path of the schema for the values file at
+// path, if it were to have one: its sibling "*.schema.json", eg
+// "values.schema.json" for "values.yaml".
+func SchemaPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".schema.json"
+}
@@ -0,0 +1,196 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/spf13/afero"
+)
+
+const testSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["name", "image"],
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "pattern": "^[a-z][a-z0-9-]*$", "maxLength": 12},
+    "replicas": {"type": "integer", "minimum": 1, "maximum": 10},
+    "ratio": {"type": "number", "exclusiveMaximum": 1, "multipleOf": 0.25},
+    "image": {
+      "type": "object",
+      "required": ["repository"],
+      "properties": {
+        "repository": {"type": "string", "minLength": 1},
+        "tag": {"type": ["string", "null"]},
+        "pullPolicy": {"enum": ["Always", "IfNotPresent", "Never"]}
+      }
+    },
+    "ports": {"type": "array", "items": {"$ref": "#/definitions/port"}, "uniqueItems": true, "maxItems": 3},
+    "labels": {"type": "object", "patternProperties": {"^app/": {"type": "string"}}, "additionalProperties": {"type": "boolean"}},
+    "tls": {"oneOf": [{"const": false}, {"type": "object", "required": ["secret"]}]},
+    "env": {"anyOf": [{"type": "string"}, {"type": "array", "minItems": 1}]},
+    "debug": {"not": {"const": true}},
+    "a/b~c": {"type": "boolean"}
+  },
+  "definitions": {
+    "port": {"type": "integer", "minimum": 1, "maximum": 65535}
+  }
+}`
+
+func TestSchema(t *testing.T) {
+	schema, err := gosubst.ParseSchema("values.schema.json", []byte(testSchema))
+	if err != nil {
+		t.Fatalf("ParseSchema() has error %q; expected nil", err)
+	}
+
+	tests := []struct {
+		values     string
+		violations []string
+	}{
+		{`{name: app, image: {repository: nginx}}`, nil},
+		{`{name: app, replicas: 3, ratio: 0.75, image: {repository: nginx, tag: null, pullPolicy: Always}, ports: [80, 443], labels: {app/tier: web, x: true}, tls: {secret: s}, env: [a], debug: false, "a/b~c": true}`, nil},
+		{`{name: app, image: {repository: nginx}, replicas: 3.0, tls: false, env: prod}`, nil},
+		{`{}`, []string{`/name: is required`, `/image: is required`}},
+		{`[]`, []string{`(root): must be an object, not an array`}},
+		{`{name: App, image: {}}`, []string{`/image/repository: is required`, `/name: must match the pattern "^[a-z][a-z0-9-]*$"`}},
+		{`{name: a-very-long-name, image: {repository: ""}}`, []string{
+			`/image/repository: must be at least 1 characters long, not 0`,
+			`/name: must be at most 12 characters long, not 16`,
+		}},
+		{`{name: app, image: {repository: nginx, tag: 1.19, pullPolicy: always}}`, []string{
+			`/image/pullPolicy: must be one of "Always", "IfNotPresent", "Never", not "always"`,
+			`/image/tag: must be a string or null, not a number`,
+		}},
+		{`{name: app, image: {repository: nginx}, replicas: 0, ratio: 1}`, []string{
+			`/ratio: must be less than 1, not 1`,
+			`/replicas: must be at least 1, not 0`,
+		}},
+		{`{name: app, image: {repository: nginx}, replicas: 2.5, ratio: 0.3}`, []string{
+			`/ratio: must be a multiple of 0.25, not 0.3`,
+			`/replicas: must be an integer, not a number`,
+		}},
+		{`{name: app, image: {repository: nginx}, ports: [80, 0, 80, 70000]}`, []string{
+			`/ports: must have at most 3 items, not 4`,
+			`/ports: must have unique items, but 0 and 2 are the same`,
+			`/ports/1: must be at least 1, not 0`,
+			`/ports/3: must be at most 65535, not 70000`,
+		}},
+		{`{name: app, image: {repository: nginx}, labels: {app/tier: 1, x: maybe}, nope: 1, "a/b~c": 1}`, []string{
+			`/a~1b~0c: must be a boolean, not an integer`,
+			`/labels/app~1tier: must be a string, not an integer`,
+			`/labels/x: must be a boolean, not a string`,
+			`/nope: isn't an allowed property`,
+		}},
+		{`{name: app, image: {repository: nginx}, tls: true, env: [], debug: true}`, []string{
+			`/debug: mustn't match the schema in not`,
+			`/env: must match at least one of the schemas in anyOf`,
+			`/tls: must match exactly one of the schemas in oneOf, not 0`,
+		}},
+	}
+	for _, test := range tests {
+		var values interface{}
+		if strings.HasPrefix(test.values, "[") {
+			values = []interface{}{}
+		} else {
+			vals, err := gosubst.ParseValues([]byte(test.values))
+			if err != nil {
+				t.Fatalf("ParseValues(%q) has error %q", test.values, err)
+			}
+			values = vals
+		}
+		err := schema.Validate(values)
+		if test.violations == nil {
+			if err != nil {
+				t.Errorf("Validate(%s) has error %q; expected nil", test.values, err)
+			}
+			continue
+		}
+		schemaErr, ok := err.(*gosubst.SchemaError)
+		if !ok {
+			t.Errorf("Validate(%s) has error %v; expected a *SchemaError", test.values, err)
+			continue
+		}
+		var violations []string
+		for _, v := range schemaErr.Violations {
+			path := v.Path
+			if path == "" {
+				path = "(root)"
+			}
+			violations = append(violations, path+": "+v.Message)
+		}
+		if strings.Join(violations, "\n") != strings.Join(test.violations, "\n") {
+			t.Errorf("Validate(%s) ==\n%s\nexpected\n%s", test.values, strings.Join(violations, "\n"), strings.Join(test.violations, "\n"))
+		}
+	}
+
+	errs := []struct {
+		schema, err string
+	}{
+		{`[]`, `: a schema must be an object or a boolean`},
+		{`{"type": "strin"}`, `/type: invalid type "strin"`},
+		{`{"properties": {"a": {"pattern": "("}}}`, "/properties/a/pattern: error parsing regexp"},
+		{`{"items": {"$ref": "#/definitions/nope"}}`, `/items/$ref: "#/definitions/nope" doesn't exist`},
+		{`{"$ref": "other.json#/a"}`, `only references within the schema`},
+		{`{"anyOf": []}`, `/anyOf: must be a list of schemas`},
+		{`{`, `unexpected end of JSON input`},
+	}
+	for _, test := range errs {
+		if _, err := gosubst.ParseSchema("s.json", []byte(test.schema)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseSchema(%s) has error %v; expected %q", test.schema, err, test.err)
+		}
+	}
+
+	// A schema that refers to itself still terminates.
+	recursive, err := gosubst.ParseSchema("s.json", []byte(`{"$ref": "#"}`))
+	if err != nil {
+		t.Fatalf("ParseSchema() has error %q; expected nil", err)
+	}
+	if err := recursive.Validate(map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "goes too deep") {
+		t.Errorf("Validate() with a recursive $ref has error %v; expected it to go too deep", err)
+	}
+}
+
+func TestValuesSchema(t *testing.T) {
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "chart/values.yaml", []byte("name: app\nreplicas: 1\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "chart/values.schema.json", []byte(`{
+  "required": ["name"],
+  "properties": {"replicas": {"type": "integer", "maximum": 5}}
+}`), 0644)
+	afero.WriteFile(gosubst.FsBackend, "chart/prod.yaml", []byte("replicas: 3\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "contract.json", []byte(`{"properties": {"name": {"enum": ["app"]}}}`), 0644)
+	afero.WriteFile(gosubst.FsBackend, "bad.json", []byte(`{"type": 1}`), 0644)
+
+	input := "{{ .Values.name }} x{{ .Values.replicas }}"
+	tests := []struct {
+		values, schemas, set []string
+		output, err          string
+	}{
+		{[]string{"chart/values.yaml", "chart/prod.yaml"}, nil, nil, "app x3", ""},
+		{[]string{"chart/values.yaml"}, []string{"contract.json"}, []string{"replicas=9"}, "", "values don't match chart/values.schema.json: /replicas: must be at most 5, not 9"},
+		{[]string{"chart/prod.yaml"}, []string{"chart/values.schema.json", "contract.json"}, []string{"replicas=a"}, "", "values don't match chart/values.schema.json, with 2 violations:\n  /name: is required\n  /replicas: must be an integer, not a string"},
+		{[]string{"chart/prod.yaml"}, []string{"contract.json"}, []string{"name=other"}, "", `values don't match contract.json: /name: must be one of "app", not "other"`},
+		{nil, []string{"nope.json"}, nil, "", "invalid schema: open nope.json: file does not exist"},
+		{nil, []string{"bad.json"}, nil, "", "invalid schema: bad.json: /type: must be a type or a list of types"},
+	}
+	for _, test := range tests {
+		opts := gosubst.DefaultOptions()
+		opts.Values, opts.Schemas, opts.Set = test.values, test.schemas, test.set
+		output, err := gosubst.Render(input, opts)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Render() with %q and %q has error %v; expected %q", test.values, test.schemas, err, test.err)
+			}
+			continue
+		}
+		if err != nil || output != test.output {
+			t.Errorf("Render() with %q and %q == %q, %v; expected %q", test.values, test.schemas, output, err, test.output)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// NOTE: Docker secrets (/run/secrets), Kubernetes secret volumes and
+//       systemd credentials ($CREDENTIALS_DIRECTORY) all hand a process
+//       its secrets as a directory with a file per secret. Each of those
+//       files becomes a Secret in .Secrets, named for the file, which
+//       prints as "[REDACTED]" however it's printed (in the template, by
+//       fmt, or as JSON) so that it can't end up in a --debug dump of the
+//       context, or an error, by accident. Using one takes asking for it
+//       by name: {{ .Secrets.db_password.Reveal }}.
+
+// CredentialsEnv is the environment variable systemd gives its services'
+// credentials directory in, which --secrets-dir defaults to.
+const CredentialsEnv = "CREDENTIALS_DIRECTORY"
+
+// redacted is what a Secret prints as.
+const redacted = "[REDACTED]"
+
+// Secret is a value that's never printed in clear text.
+type Secret struct {
+	value string
+}
+
+// NewSecret returns a Secret holding value.
+func NewSecret(value string) Secret {
+	return Secret{value: value}
+}
+
+// Reveal returns the secret's value.
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+// String redacts the secret.
+func (s Secret) String() string {
+	return redacted
+}
+
+// Format redacts the secret, whatever the verb (%v, %#v, %q, %x, ...).
+func (s Secret) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, redacted)
+}
+
+// MarshalJSON redacts the secret, for toJson.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+// LoadSecrets reads the files in each of the given directories (through
+// FsBackend) as Secrets, named for their files, with files in later
+// directories overriding earlier ones. Hidden files (including the
+// "..data" links of Kubernetes' volumes) and directories are skipped.
+func LoadSecrets(dirs ...string) (map[string]interface{}, error) {
+	secrets := make(map[string]interface{})
+	for _, dir := range dirs {
+		infos, err := afero.ReadDir(FsBackend, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			// Stat it again to follow any symlink, as Kubernetes uses.
+			path := filepath.Join(dir, name)
+			if stat, err := FsBackend.Stat(path); err != nil || stat.IsDir() {
+				continue
+			}
+			data, err := afero.ReadFile(FsBackend, path)
+			if err != nil {
+				return nil, err
+			}
+			secrets[name] = NewSecret(string(data))
+		}
+	}
+	return secrets, nil
+}
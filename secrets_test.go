@@ -0,0 +1,100 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/spf13/afero"
+)
+
+func TestSecret(t *testing.T) {
+	secret := gosubst.NewSecret("hunter2")
+	if secret.Reveal() != "hunter2" {
+		t.Errorf("Reveal() == %q; expected %q", secret.Reveal(), "hunter2")
+	}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%d", "%10.3v"} {
+		if out := fmt.Sprintf(format, secret); out != "[REDACTED]" {
+			t.Errorf("Sprintf(%q, secret) == %q; expected it redacted", format, out)
+		}
+	}
+	nested := map[string]interface{}{"a": []interface{}{secret}}
+	if out := fmt.Sprintf("%v %+v", nested, &secret); strings.Contains(out, "hunter2") {
+		t.Errorf("Sprintf() with a nested secret == %q; expected it redacted", out)
+	}
+	if out, err := json.Marshal(nested); err != nil || string(out) != `{"a":["[REDACTED]"]}` {
+		t.Errorf("json.Marshal() with a secret == %s, %v; expected it redacted", out, err)
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/db_password", []byte("hunter2"), 0400)
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/api_key", []byte("abc\n"), 0400)
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/empty", []byte(""), 0400)
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/..data/db_password", []byte("hunter2"), 0400)
+	afero.WriteFile(gosubst.FsBackend, "/run/secrets/sub/nope", []byte("nope"), 0400)
+	afero.WriteFile(gosubst.FsBackend, "/run/credentials/api_key", []byte("def"), 0400)
+
+	secrets, err := gosubst.LoadSecrets("/run/secrets", "/run/credentials")
+	if err != nil {
+		t.Fatalf("LoadSecrets() has error %q; expected nil", err)
+	}
+	expected := map[string]string{"db_password": "hunter2", "api_key": "def", "empty": ""}
+	if len(secrets) != len(expected) {
+		t.Errorf("LoadSecrets() == %v; expected %d secrets", secrets, len(expected))
+	}
+	for name, val := range expected {
+		if secret, ok := secrets[name].(gosubst.Secret); !ok || secret.Reveal() != val {
+			t.Errorf("LoadSecrets()[%q] == %#v; expected a secret of %q", name, secrets[name], val)
+		}
+	}
+	if _, err := gosubst.LoadSecrets("/run/nope"); err == nil {
+		t.Errorf("LoadSecrets() of a missing directory has no error; expected one")
+	}
+
+	opts := gosubst.DefaultOptions()
+	opts.SecretsDirs = []string{"/run/secrets"}
+	tests := []struct {
+		input, output, err string
+	}{
+		{`{{ .Secrets.db_password.Reveal }}`, "hunter2", ""},
+		{`{{ .Secrets.api_key.Reveal | trim | b64enc }}`, "YWJj", ""},
+		{`{{ .Secrets.db_password }} {{ .Secrets }} {{ . }} {{ printf "%v" .Secrets.db_password }}`, "", ""},
+		{`{{ .Secrets | toJson }} {{ .Secrets | toPrettyJson }} {{ .Secrets | toString }}`, "", ""},
+		{`{{ hasKey .Secrets "db_password" }} {{ hasKey .Secrets "nope" }}`, "true false", ""},
+		{`{{ requiredVals .Secrets.db_password }}`, "", ""},
+		{`{{ requiredVals .Secrets.empty }}`, "", "required value is empty: [REDACTED]"},
+		{`{{ fail .Secrets.db_password }}`, "", "wrong type for value"},
+	}
+	for _, test := range tests {
+		output, err := gosubst.Render(test.input, opts)
+		if strings.Contains(output, "hunter2") && !strings.Contains(test.input, "Reveal") {
+			t.Errorf("Render(%q) == %q; expected the secret redacted", test.input, output)
+		}
+		if err != nil && strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("Render(%q) has error %q; expected the secret redacted", test.input, err)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Render(%q) has error %v; expected %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil || (test.output != "" && output != test.output) {
+			t.Errorf("Render(%q) == %q, %v; expected %q", test.input, output, err, test.output)
+		}
+	}
+
+	opts.SecretsDirs = []string{"/run/nope"}
+	if _, err := gosubst.Render("", opts); err == nil || !strings.HasPrefix(err.Error(), "invalid secrets dir: ") {
+		t.Errorf("Render() with a missing secrets dir has error %v; expected it to be invalid", err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// NOTE: --set and friends use Helm's syntax, so that the same command
+//       lines work with both:
+//
+//       a.b=c,d=e        set several values at once
+//       a.b\.c=x         a key with a "." in it (any character can be
+//                        escaped with a backslash, including a ",")
+//       list[0].name=x   an element of a list, which is grown to fit
+//       list={a,b,c}     a whole list
+//       a=null           delete a key
+//
+//       With --set, values are typed as Helm types them: true and false
+//       are booleans, and numbers without leading zeros are integers;
+//       anything else is a string. --set-string keeps everything a
+//       string, and --set-file uses the contents of the file named.
+
+// maxSetIndex is the largest list index that can be set, so that a typo
+// can't eat all of the memory.
+const maxSetIndex = 65536
+
+// SetValues parses the assignments in s (as given to --set), setting
+// them in values.
+func SetValues(values map[string]interface{}, s string) error {
+	return parseSet(values, s, true, typedValue)
+}
+
+// SetStringValues parses the assignments in s (as given to --set-string),
+// setting them in values as strings.
+func SetStringValues(values map[string]interface{}, s string) error {
+	return parseSet(values, s, true, func(val string) interface{} { return val })
+}
+
+// SetFileValues parses the assignments in s (as given to --set-file),
+// setting them in values to the contents of the files they name
+// (through FsBackend).
+func SetFileValues(values map[string]interface{}, s string) error {
+	var readErr error
+	err := parseSet(values, s, false, func(path string) interface{} {
+		data, err := afero.ReadFile(FsBackend, path)
+		if err != nil && readErr == nil {
+			readErr = err
+		}
+		return string(data)
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// typedValue types a value given to --set.
+func typedValue(val string) interface{} {
+	switch {
+	case val == "true":
+		return true
+	case val == "false":
+		return false
+	case val == "null":
+		return nil
+	case val == "0":
+		return int64(0)
+	case val != "" && val[0] != '0' && !(val[0] == '-' && strings.HasPrefix(val[1:], "0")):
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return n
+		}
+	}
+	return val
+}
+
+// pathElem is a single step in the path to a value: either a map key,
+// or (if index isn't -1) a list index.
+type pathElem struct {
+	key   string
+	index int
+}
+
+// parseSet parses s as a comma-separated list of assignments, setting
+// the value of each (as returned by value) in values. If lists is set,
+// {a,b} is a list.
+func parseSet(values map[string]interface{}, s string, lists bool, value func(string) interface{}) error {
+	for s != "" {
+		path, rest, err := parseSetPath(s)
+		if err != nil {
+			return err
+		}
+		var val interface{}
+		if lists && strings.HasPrefix(rest, "{") {
+			var items []string
+			if items, rest, err = parseSetList(rest[1:]); err != nil {
+				return fmt.Errorf("%s: %s", s[:len(s)-len(rest)], err)
+			}
+			list := make([]interface{}, len(items))
+			for i, item := range items {
+				list[i] = value(item)
+			}
+			val = list
+		} else {
+			var raw string
+			raw, rest = scanSetValue(rest, ",")
+			val = value(raw)
+		}
+		setPath(values, path, val)
+		if rest != "" {
+			rest = rest[1:] // the ","
+		}
+		s = rest
+	}
+	return nil
+}
+
+// parseSetPath parses the path at the start of s, up to its "=",
+// returning it and what comes after the "=".
+func parseSetPath(s string) ([]pathElem, string, error) {
+	var path []pathElem
+	var key strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+			key.WriteByte(s[i])
+		case '.', '=', ',':
+			if key.Len() == 0 && (len(path) == 0 || path[len(path)-1].index < 0) {
+				return nil, "", fmt.Errorf("%s: empty key", s[:i+1])
+			}
+			if key.Len() > 0 {
+				path = append(path, pathElem{key: key.String(), index: -1})
+				key.Reset()
+			}
+			if c == '=' {
+				return path, s[i+1:], nil
+			}
+			if c == ',' {
+				return nil, "", fmt.Errorf("%s: missing \"=\"", s[:i])
+			}
+		case '[':
+			if key.Len() == 0 && len(path) == 0 {
+				return nil, "", fmt.Errorf("%s: a list index must follow a key", s[:i+1])
+			}
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, "", fmt.Errorf("%s: unterminated list index", s)
+			}
+			index, err := strconv.Atoi(s[i+1 : i+end])
+			if err != nil || index < 0 || index > maxSetIndex {
+				return nil, "", fmt.Errorf("%s: invalid list index %q", s[:i+end+1], s[i+1:i+end])
+			}
+			if key.Len() > 0 {
+				path = append(path, pathElem{key: key.String(), index: -1})
+				key.Reset()
+			}
+			path = append(path, pathElem{index: index})
+			i += end
+		default:
+			key.WriteByte(c)
+		}
+	}
+	return nil, "", fmt.Errorf("%s: missing \"=\"", s)
+}
+
+// scanSetValue returns the value at the start of s, up to the first of
+// the stop characters that isn't escaped, and the rest of s from there.
+func scanSetValue(s, stop string) (string, string) {
+	var val strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			val.WriteByte(s[i])
+		case strings.IndexByte(stop, s[i]) >= 0:
+			return val.String(), s[i:]
+		default:
+			val.WriteByte(s[i])
+		}
+	}
+	return val.String(), ""
+}
+
+// parseSetList parses the items of a list, after its "{", returning them
+// and the rest of s after its "}".
+func parseSetList(s string) ([]string, string, error) {
+	var items []string
+	if strings.HasPrefix(s, "}") {
+		return items, s[1:], nil
+	}
+	for {
+		var item string
+		item, s = scanSetValue(s, ",}")
+		items = append(items, item)
+		if s == "" {
+			return nil, "", errors.New("unterminated list")
+		}
+		if s[0] == '}' {
+			s = s[1:]
+			if s != "" && s[0] != ',' {
+				return nil, "", fmt.Errorf("unexpected %q after the list", s)
+			}
+			return items, s, nil
+		}
+		s = s[1:]
+	}
+}
+
+// setPath sets the value at path inside of cur, which may be nil (or
+// any other value, which is replaced), returning the new cur.
+func setPath(cur interface{}, path []pathElem, val interface{}) interface{} {
+	if len(path) == 0 {
+		return val
+	}
+	el := path[0]
+	if el.index < 0 {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+		}
+		if len(path) == 1 && val == nil {
+			delete(m, el.key)
+		} else {
+			m[el.key] = setPath(m[el.key], path[1:], val)
+		}
+		return m
+	}
+	list, _ := cur.([]interface{})
+	for len(list) <= el.index {
+		list = append(list, nil)
+	}
+	list[el.index] = setPath(list[el.index], path[1:], val)
+	return list
+}
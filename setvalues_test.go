@@ -0,0 +1,121 @@
+package main_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/spf13/afero"
+)
+
+type values = map[string]interface{}
+
+var setTests = []struct {
+	in  string
+	out values
+}{
+	{"name=app", values{"name": "app"}},
+	{"a.b.c=x,d=y", values{"a": values{"b": values{"c": "x"}}, "d": "y"}},
+	{"replicas=3,neg=-2,zero=0,octal=0123,float=1.5,big=99999999999999999999", values{
+		"replicas": int64(3), "neg": int64(-2), "zero": int64(0), "octal": "0123", "float": "1.5", "big": "99999999999999999999",
+	}},
+	{"on=true,off=false,True=True", values{"on": true, "off": false, "True": "True"}},
+	{`a\.b=c,x=1\,2,y=a\\b`, values{"a.b": "c", "x": "1,2", "y": `a\b`}},
+	{"list={a,1,true},empty={}", values{"list": []interface{}{"a", int64(1), true}, "empty": []interface{}{}}},
+	{"list[2]=c", values{"list": []interface{}{nil, nil, "c"}}},
+	{"list[0].name=a,list[0].port=80,list[1].name=b", values{"list": []interface{}{
+		values{"name": "a", "port": int64(80)},
+		values{"name": "b"},
+	}}},
+	{"matrix[1][0]=x", values{"matrix": []interface{}{nil, []interface{}{"x"}}}},
+	{"a=,b=x=y", values{"a": "", "b": "x=y"}},
+	{"a.b=1,a=null", values{}},
+	{"a=1,a.b=2", values{"a": values{"b": int64(2)}}},
+}
+
+func TestSetValues(t *testing.T) {
+	for _, test := range setTests {
+		vals := values{}
+		if err := gosubst.SetValues(vals, test.in); err != nil {
+			t.Errorf("SetValues(%q) has error %q; expected nil", test.in, err)
+		}
+		if !reflect.DeepEqual(vals, test.out) {
+			t.Errorf("SetValues(%q) ==\n%#v\nexpected\n%#v", test.in, vals, test.out)
+		}
+	}
+
+	vals := values{"image": values{"repository": "nginx", "tag": "latest"}}
+	if err := gosubst.SetStringValues(vals, "image.tag=0123,replicas=3,on=true,list={1,2}"); err != nil {
+		t.Errorf("SetStringValues() has error %q; expected nil", err)
+	}
+	expected := values{
+		"image":    values{"repository": "nginx", "tag": "0123"},
+		"replicas": "3",
+		"on":       "true",
+		"list":     []interface{}{"1", "2"},
+	}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("SetStringValues() ==\n%#v\nexpected\n%#v", vals, expected)
+	}
+
+	errs := []struct {
+		in, err string
+	}{
+		{"name", `name: missing "="`},
+		{"a=1,b", `b: missing "="`},
+		{"a,b=1", `a: missing "="`},
+		{"=x", `=: empty key`},
+		{"a..b=x", `a..: empty key`},
+		{"[0]=x", `[: a list index must follow a key`},
+		{"a[x]=1", `a[x]: invalid list index "x"`},
+		{"a[99999999]=1", `a[99999999]: invalid list index "99999999"`},
+		{"a[0=1", `a[0=1: unterminated list index`},
+		{"a={b,c", `a={b,c: unterminated list`},
+		{"a={b}c", `a={b}c: unexpected "c" after the list`},
+	}
+	for _, test := range errs {
+		if err := gosubst.SetValues(values{}, test.in); err == nil || err.Error() != test.err {
+			t.Errorf("SetValues(%q) has error %v; expected %q", test.in, err, test.err)
+		}
+	}
+}
+
+func TestSetFileValues(t *testing.T) {
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "tls.crt", []byte("-----BEGIN-----\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "values.yaml", []byte("image: {tag: latest}\nreplicas: 1\n"), 0644)
+
+	vals := values{}
+	if err := gosubst.SetFileValues(vals, "tls.crt=tls.crt"); err != nil {
+		t.Errorf("SetFileValues() has error %q; expected nil", err)
+	}
+	if expected := (values{"tls": values{"crt": "-----BEGIN-----\n"}}); !reflect.DeepEqual(vals, expected) {
+		t.Errorf("SetFileValues() ==\n%#v\nexpected\n%#v", vals, expected)
+	}
+	if err := gosubst.SetFileValues(vals, "a=nope"); err == nil || !strings.Contains(err.Error(), "file does not exist") {
+		t.Errorf("SetFileValues() with a missing file has error %v; expected it to not exist", err)
+	}
+
+	// Files first, then --set, --set-string and --set-file.
+	opts := gosubst.DefaultOptions()
+	opts.Values = []string{"values.yaml"}
+	opts.SetFile = []string{"image.tag=tls.crt"}
+	opts.SetString = []string{"image.tag=string,replicas=2"}
+	opts.Set = []string{"image.tag=set,replicas=3", "image.pullPolicy=Always"}
+	input := "{{ .Values.image.tag | trim }} {{ .Values.replicas | kindOf }} {{ .Values.image.pullPolicy }}"
+	output, err := gosubst.Render(input, opts)
+	if expected := "-----BEGIN----- string Always"; err != nil || output != expected {
+		t.Errorf("Render(%q) == %q, %v; expected %q", input, output, err, expected)
+	}
+
+	opts.Set = []string{"oops"}
+	if _, err := gosubst.Render(input, opts); err == nil || err.Error() != `invalid --set "oops": oops: missing "="` {
+		t.Errorf("Render() with an invalid --set has error %v; expected it to be invalid", err)
+	}
+}
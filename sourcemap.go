@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NOTE: the expansion pass runs before the template is parsed, so a
+//       value with newlines in it (a PEM certificate, say) shifts the
+//       line numbers in any errors from the template pass. A SourceMap
+//       records where each reference was replaced, so that those errors
+//       can be made to point at the input as it was written.
+
+// SourceMap maps offsets in the output of an expansion back to offsets
+// in its input.
+type SourceMap struct {
+	input, output string
+	edits         []edit // the references replaced, in order
+}
+
+// edit is a single replaced reference.
+type edit struct {
+	in, out       int // where it starts in the input and output
+	inLen, outLen int // how long it is in each
+}
+
+// ExpandMapped is like Expand, but also returns a SourceMap from the
+// result back to s.
+func (e *Expander) ExpandMapped(s string) (string, *SourceMap, error) {
+	m := &SourceMap{input: s}
+	e.srcmap = m
+	defer func() { e.srcmap = nil }()
+	out, err := e.Expand(s)
+	if err != nil {
+		return "", nil, err
+	}
+	m.output = out
+	return out, m, nil
+}
+
+// Offset returns the offset in the input that the given offset in the
+// output came from. Anywhere in the value of a reference maps to the
+// start of the reference.
+func (m *SourceMap) Offset(out int) int {
+	i := sort.Search(len(m.edits), func(i int) bool { return m.edits[i].out > out })
+	if i == 0 {
+		return out
+	}
+	ed := m.edits[i-1]
+	if out < ed.out+ed.outLen {
+		return ed.in
+	}
+	return ed.in + ed.inLen + out - (ed.out + ed.outLen)
+}
+
+// Position maps a position in the output to one in the input. As in the
+// errors from text/template, lines count from 1 and columns (in bytes)
+// from 0; a column of -1 means the start of the line.
+func (m *SourceMap) Position(line, col int) (int, int) {
+	out := lineStart(m.output, line)
+	if col > 0 {
+		out += col
+	}
+	in := m.Offset(out)
+	start := strings.LastIndexByte(m.input[:in], '\n') + 1
+	return strings.Count(m.input[:in], "\n") + 1, in - start
+}
+
+// lineStart returns the offset in s of the start of the given line.
+func lineStart(s string, line int) int {
+	offset := 0
+	for ; line > 1; line-- {
+		nl := strings.IndexByte(s[offset:], '\n')
+		if nl < 0 {
+			return len(s)
+		}
+		offset += nl + 1
+	}
+	return offset
+}
+
+// Rewrite returns err with the positions in it of the form "name:line"
+// or "name:line:col" (as in errors from text/template, where name is the
+// template's name) mapped back to the input. A nil SourceMap leaves err
+// as it is.
+func (m *SourceMap) Rewrite(err error, name string) error {
+	if m == nil || err == nil || len(m.edits) == 0 {
+		return err
+	}
+	re := regexp.MustCompile(regexp.QuoteMeta(name) + `:(\d+)(?::(\d+))?`)
+	msg := re.ReplaceAllStringFunc(err.Error(), func(pos string) string {
+		match := re.FindStringSubmatch(pos)
+		line, _ := strconv.Atoi(match[1])
+		col := -1
+		if match[2] != "" {
+			col, _ = strconv.Atoi(match[2])
+		}
+		line, col = m.Position(line, col)
+		if match[2] == "" {
+			return name + ":" + strconv.Itoa(line)
+		}
+		return name + ":" + strconv.Itoa(line) + ":" + strconv.Itoa(col)
+	})
+	return &sourceError{msg: msg, err: err}
+}
+
+// sourceError is an error with its positions rewritten by a SourceMap.
+type sourceError struct {
+	msg string
+	err error
+}
+
+func (e *sourceError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the original error.
+func (e *sourceError) Unwrap() error {
+	return e.err
+}
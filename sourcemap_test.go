@@ -0,0 +1,89 @@
+package main_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"text/template"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/hews/gosubst/internal/testutils"
+)
+
+func TestSourceMap(t *testing.T) {
+	e := gosubst.NewExpander(func(name string) (string, bool) {
+		return map[string]string{"CERT": "l1\nl2\nl3", "SHORT": "s"}[name], true
+	})
+	input := "a: ${CERT}\nb: ${SHORT} $${X} ${NOPE:-${CERT}} end\nc"
+	output, m, err := e.ExpandMapped(input)
+	if err != nil {
+		t.Fatalf("Expander.ExpandMapped() has error %q; expected nil", err)
+	}
+	if expected := "a: l1\nl2\nl3\nb: s ${X} l1\nl2\nl3 end\nc"; output != expected {
+		t.Fatalf("Expander.ExpandMapped() == %q; expected %q", output, expected)
+	}
+
+	offsets := []struct{ out, in int }{
+		{0, 0},   // "a"
+		{3, 3},   // "l1"
+		{10, 3},  // "l3"
+		{12, 11}, // "b"
+		{15, 14}, // "s"
+		{17, 23}, // "${X}"
+		{19, 26}, // "X"
+		{22, 29}, // "l1"
+		{31, 46}, // "end"
+		{35, 50}, // "c"
+	}
+	for _, test := range offsets {
+		if in := m.Offset(test.out); in != test.in {
+			t.Errorf("SourceMap.Offset(%d) == %d; expected %d", test.out, in, test.in)
+		}
+	}
+
+	positions := []struct{ line, col, inLine, inCol int }{
+		{1, 0, 1, 0},
+		{2, -1, 1, 3},
+		{3, 1, 1, 3},
+		{4, 3, 2, 3},
+		{6, 3, 2, 35},
+		{7, 0, 3, 0},
+	}
+	for _, test := range positions {
+		if line, col := m.Position(test.line, test.col); line != test.inLine || col != test.inCol {
+			t.Errorf("SourceMap.Position(%d, %d) == %d, %d; expected %d, %d", test.line, test.col, line, col, test.inLine, test.inCol)
+		}
+	}
+
+	err = m.Rewrite(errors.New("template: <stdin>:6:3: at <.X>: oops, and <stdin>:4"), "<stdin>")
+	if expected := "template: <stdin>:2:35: at <.X>: oops, and <stdin>:2"; err.Error() != expected {
+		t.Errorf("SourceMap.Rewrite() == %q; expected %q", err, expected)
+	}
+}
+
+func TestRenderSourceMap(t *testing.T) {
+	resetEnvirnonment := testutils.ClearEnvironment(t)
+	defer resetEnvirnonment()
+
+	os.Setenv("TLS_CERT", "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----")
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"cert: |\n${TLS_CERT}\nkey: {{ if }}\n", "template: <stdin>:3: missing value for if"},
+		{"cert: ${TLS_CERT}\nname: {{ .Proc.Nope }}\n", `template: <stdin>:2:14: executing "<stdin>" at <.Proc.Nope>: can't evaluate field Nope in type main.ProcessDetails`},
+		{"cert: ${TLS_CERT} {{ .Proc.Nope }}\n", `template: <stdin>:1:26: executing "<stdin>" at <.Proc.Nope>: can't evaluate field Nope in type main.ProcessDetails`},
+	}
+	for _, test := range tests {
+		_, err := gosubst.Render(test.input, gosubst.DefaultOptions())
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Render(%q) has error %v; expected %q", test.input, err, test.err)
+		}
+		var execErr template.ExecError
+		if strings.Contains(test.err, "executing") && !errors.As(err, &execErr) {
+			t.Errorf("Render(%q) has error %T; expected it to wrap a template.ExecError", test.input, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// NOTE: the streaming expander reads its input a chunk at a time and
+//       expands as much of each chunk as it can, holding back anything
+//       the next chunk might change the meaning of: a reference that
+//       hasn't been closed yet, a "$" that might be the start of one, a
+//       character split between chunks, and so on. What's held back is
+//       capped at maxPending bytes; a reference that's still open after
+//       that many is given up on, and treated as if it were never
+//       closed at all.
+
+// streamChunk is the most of the input ExpandStream reads at a time.
+const streamChunk = 32 * 1024
+
+// maxPending is the most ExpandStream holds back, waiting for the rest
+// of a reference.
+const maxPending = 64 * 1024
+
+// minRescan is how much can be held back before ExpandStream waits for
+// it to double in size before trying to expand it again.
+const minRescan = 1024
+
+// ExpandStream copies r to w, replacing ${var} as Expand does, but using
+// a fixed amount of memory rather than reading all of r first. Since the
+// output is written as it goes, a failed ${VAR:?word} reference leaves
+// what came before it written, and in Strict mode (or with
+// RejectBadSyntax) the error is only returned once all of r has been.
+func (e *Expander) ExpandStream(w io.Writer, r io.Reader) error {
+	e.reset()
+	chunk := make([]byte, streamChunk)
+	held, wait := "", 0
+	for eof := false; !eof; {
+		n, err := r.Read(chunk)
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return err
+		}
+
+		s := held + string(chunk[:n])
+		if !eof && len(s) < wait {
+			// Don't rescan a long reference every time a little more of
+			// it arrives.
+			held = s
+			continue
+		}
+		cut := len(s)
+		if !eof {
+			cut = fullRunes(s)
+		}
+		used, err := e.expandTo(w, s[:cut], !eof)
+		if err != nil {
+			return err
+		}
+		held = s[used:]
+
+		// Give up on anything that's been held back for too long, which
+		// is always at the start of what's held.
+		for len(held) > maxPending {
+			k := 1
+			if syn := e.syntax(); syn.nests() && strings.HasPrefix(held, syn.Open) {
+				k = len(syn.Open)
+			}
+			if _, err := e.expandTo(w, held[:k], false); err != nil {
+				return err
+			}
+			used, err := e.expandTo(w, held[k:fullRunes(held)], true)
+			if err != nil {
+				return err
+			}
+			held = held[k+used:]
+		}
+		wait = 0
+		if len(held) > minRescan {
+			wait = 2 * len(held)
+		}
+		if wait > maxPending {
+			wait = maxPending + 1
+		}
+	}
+	return e.collected()
+}
+
+// expandTo expands s, the next part of the input, writing the result to
+// w and returning how much of s was expanded (see expandPart).
+func (e *Expander) expandTo(w io.Writer, s string, partial bool) (int, error) {
+	e.src = s
+	out, n, err := e.expandPart(s, 0, partial)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w, out); err != nil {
+		return 0, err
+	}
+
+	// Keep track of the output so far, for escaping, and where the next
+	// part starts, for error messages.
+	e.lead += out
+	if len(e.lead) > maxContext {
+		e.lead = e.lead[len(e.lead)-maxContext:]
+	}
+	done := s[:n]
+	if nl := strings.LastIndexByte(done, '\n'); nl >= 0 {
+		e.srcLine += strings.Count(done, "\n")
+		e.srcCol = utf8.RuneCountInString(done[nl+1:])
+	} else {
+		e.srcCol += utf8.RuneCountInString(done)
+	}
+	e.srcAt += n
+	return n, nil
+}
+
+// unfinished reports whether s, the rest of the part of the input being
+// expanded, begins with something that may only be understood once more
+// of the input has been read. Outside is set if s isn't inside of a
+// template action.
+func (e *Expander) unfinished(s string, outside bool) bool {
+	syn := e.syntax()
+	switch {
+	case isPrefix(s, syn.Open) || isPrefix(s, syn.Escape):
+		return true
+	case strings.HasPrefix(s, syn.Open):
+		end := syn.closing(s, len(syn.Open))
+		if end < 0 {
+			return true
+		}
+		// How a value's escaped depends on the rest of its line.
+		escaped := e.Escape != EscapeNone || strings.Contains(s[:end], "@")
+		return escaped && strings.IndexByte(s[end:], '\n') < 0
+	case !outside:
+		return false
+	case s == "{":
+		return true
+	case strings.HasPrefix(s, "{{"):
+		// It might be a region marker, or (if we're looking for them) a
+		// comment or raw string.
+		return actionLength(s) == len(s) && !strings.HasSuffix(s, "}}")
+	case !e.Bare:
+		return false
+	case s == "$" || s == "$$":
+		return true
+	case s[0] == '$':
+		// The name might go on, or be escaped.
+		_, w := getShellName(s[1:])
+		return w == len(s)-1 || e.Escape != EscapeNone && strings.IndexByte(s, '\n') < 0
+	}
+	return false
+}
+
+// isPrefix reports whether s is a proper prefix of delim.
+func isPrefix(s, delim string) bool {
+	return len(s) < len(delim) && strings.HasPrefix(delim, s)
+}
+
+// fullRunes returns the length of s without any incomplete character at
+// its end.
+func fullRunes(s string) int {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(s)
+}
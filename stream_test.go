@@ -0,0 +1,107 @@
+package main_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+// streamReaders split the input up differently, so that the chunks end
+// in every possible place.
+var streamReaders = map[string]func(string) io.Reader{
+	"whole":    func(s string) io.Reader { return strings.NewReader(s) },
+	"one byte": func(s string) io.Reader { return iotest.OneByteReader(strings.NewReader(s)) },
+	"half":     func(s string) io.Reader { return iotest.HalfReader(strings.NewReader(s)) },
+}
+
+// checkStream checks ExpandStream gives the same result as Expand.
+func checkStream(t *testing.T, e *gosubst.Expander, in string) {
+	expected, expectedErr := e.Expand(in)
+	for name, reader := range streamReaders {
+		var out bytes.Buffer
+		err := e.ExpandStream(&out, reader(in))
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("Expander.ExpandStream(%q) (%s) has error %v; expected %v", in, name, err, expectedErr)
+			continue
+		}
+		if err == nil && out.String() != expected {
+			t.Errorf("Expander.ExpandStream(%q) (%s) == %q; expected %q", in, name, out.String(), expected)
+		}
+	}
+}
+
+func TestExpandStream(t *testing.T) {
+	getenv := func(s string) (string, bool) {
+		val := testGetenv(s)
+		return val, val != ""
+	}
+	for _, test := range expandTests {
+		var out bytes.Buffer
+		if err := gosubst.NewExpander(getenv).ExpandStream(&out, strings.NewReader(test.in)); err == nil && out.String() != test.out {
+			t.Errorf("Expander.ExpandStream(%q) == %q; expected %q", test.in, out.String(), test.out)
+		}
+		checkStream(t, gosubst.NewExpander(getenv), test.in)
+	}
+	for _, test := range expanderTests {
+		checkStream(t, gosubst.NewExpander(testLookupEnv), test.in)
+	}
+	for _, test := range stringOpTests {
+		checkStream(t, gosubst.NewExpander(testImageEnv), test.in)
+	}
+	for _, test := range nestedTests {
+		checkStream(t, gosubst.NewExpander(testDeployEnv), test.in)
+	}
+	for _, test := range bareTests {
+		e := gosubst.NewExpander(getenv)
+		e.Bare = true
+		checkStream(t, e, test.in)
+	}
+	for _, test := range badSyntaxTests {
+		e := gosubst.NewExpander(testLookupEnv)
+		for _, policy := range []gosubst.SyntaxPolicy{gosubst.EatBadSyntax, gosubst.KeepBadSyntax, gosubst.RejectBadSyntax} {
+			e.OnBadSyntax = policy
+			checkStream(t, e, test.in)
+		}
+	}
+	for _, name := range []string{"backslash", "percent", "at", "brackets"} {
+		e := gosubst.NewExpander(testLookupEnv)
+		e.Syntax = gosubst.Syntaxes[name]
+		checkStream(t, e, `\${FULL} %%{FULL} %{FULL} \[[FULL]] [[FULL]] @FULL@ a@b.c ü@FULL@`)
+	}
+}
+
+func TestExpandStreamStrict(t *testing.T) {
+	e := gosubst.NewExpander(testLookupEnv)
+	e.Strict = true
+	checkStream(t, e, "name: ${APP_NAEM}\nimage: ${IMG:-nginx}:${TAG}\n  ü: ${FULL} ${EMPTY} ${#UNSET}")
+}
+
+func TestExpandStreamLong(t *testing.T) {
+	// A reference that's never closed can't hold up the output forever.
+	in := "${FULL} ${" + strings.Repeat("ü and $", 50000) + "${FULL}"
+	checkStream(t, gosubst.NewExpander(testLookupEnv), in)
+
+	in = strings.Repeat("${FULL}$", 20000)
+	checkStream(t, gosubst.NewExpander(testLookupEnv), in)
+}
+
+func TestExpandStreamActions(t *testing.T) {
+	// A reference held back for escaping is still inside of its action
+	// once the rest of the line arrives, so $x is left alone.
+	line := `{{ printf "%s %s" "${FULL@json}" $x }} trailing` + "\n$FULL\n"
+	split := strings.Repeat("-", 32*1024-strings.Index(line, " trailing")) + line
+	for _, in := range []string{line, split, `{{ printf "${FULL} \" $x" $y }} {{ $z }} $FULL`} {
+		e := gosubst.NewExpander(testLookupEnv)
+		e.Bare = true
+		checkStream(t, e, in)
+		e.Escape = gosubst.EscapeJSON
+		checkStream(t, e, in)
+		e.SkipLiterals = true
+		checkStream(t, e, in)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Syntax describes what references look like to an Expander, so that
+// the expansion pass can coexist with file formats that already use
+// "${...}" for their own purposes.
+type Syntax struct {
+	Open   string // opens a reference, eg "${"
+	Close  string // closes a reference, eg "}"
+	Escape string // written in place of Open to output it literally, eg "$${"
+}
+
+// DefaultSyntax is the syntax used when an Expander isn't given one.
+var DefaultSyntax = Syntax{Open: "${", Close: "}", Escape: "$${"}
+
+// Syntaxes are the named syntaxes understood by ParseSyntax.
+var Syntaxes = map[string]Syntax{
+	"dollar":    DefaultSyntax,
+	"backslash": {Open: "${", Close: "}", Escape: `\${`},
+	"percent":   {Open: "%{", Close: "}", Escape: "%%{"},
+	"at":        {Open: "@", Close: "@", Escape: "@@"},
+	"brackets":  {Open: "[[", Close: "]]", Escape: `\[[`},
+}
+
+// ParseSyntax returns the Syntax described by spec, which is either the
+// name of one of the Syntaxes, or the opening and closing delimiters and
+// (optionally) the escape sequence, separated by spaces, eg "%{ } %%{".
+// If the escape isn't given, it's the first character of the opening
+// delimiter followed by the delimiter itself, eg "%%{" for "%{".
+func ParseSyntax(spec string) (Syntax, error) {
+	if syn, ok := Syntaxes[spec]; ok {
+		return syn, nil
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 2:
+		return Syntax{Open: fields[0], Close: fields[1], Escape: fields[0][:1] + fields[0]}, nil
+	case 3:
+		return Syntax{Open: fields[0], Close: fields[1], Escape: fields[2]}, nil
+	}
+	names := make([]string, 0, len(Syntaxes))
+	for name := range Syntaxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return Syntax{}, fmt.Errorf(
+		"invalid syntax %q: must be one of %s, or \"OPEN CLOSE [ESCAPE]\"",
+		spec,
+		strings.Join(names, ", "),
+	)
+}
+
+// nests reports whether references can be nested in this syntax, which
+// they can't be if the delimiters are the same at both ends.
+func (syn Syntax) nests() bool {
+	return syn.Open != syn.Close
+}
@@ -0,0 +1,73 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+func TestParseSyntax(t *testing.T) {
+	tests := []struct {
+		spec   string
+		syntax gosubst.Syntax
+		err    string
+	}{
+		{"dollar", gosubst.DefaultSyntax, ""},
+		{"at", gosubst.Syntax{Open: "@", Close: "@", Escape: "@@"}, ""},
+		{"backslash", gosubst.Syntax{Open: "${", Close: "}", Escape: `\${`}, ""},
+		{"%{ }", gosubst.Syntax{Open: "%{", Close: "}", Escape: "%%{"}, ""},
+		{"<< >> \\<<", gosubst.Syntax{Open: "<<", Close: ">>", Escape: `\<<`}, ""},
+		{"nope", gosubst.Syntax{}, "invalid syntax \"nope\": must be one of at, backslash, brackets, dollar, percent"},
+		{"", gosubst.Syntax{}, "invalid syntax"},
+	}
+	for _, test := range tests {
+		syntax, err := gosubst.ParseSyntax(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ParseSyntax(%q) has error %v; expected %q", test.spec, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSyntax(%q) has error %q; expected nil", test.spec, err)
+		}
+		if syntax != test.syntax {
+			t.Errorf("ParseSyntax(%q) == %+v; expected %+v", test.spec, syntax, test.syntax)
+		}
+	}
+}
+
+var syntaxTests = []struct {
+	syntax  string
+	in, out string
+}{
+	{"dollar", "${HOME} $${HOME} @HOME@", "/usr/gopher ${HOME} @HOME@"},
+	{"backslash", `${HOME} \${HOME} $${HOME}`, `/usr/gopher ${HOME} $/usr/gopher`},
+	{"at", "prefix=@HOME@ @@HOME@@ ${HOME}", "prefix=/usr/gopher @HOME@ ${HOME}"},
+	{"at", "mail me@example.com, @H@!", "mail me@example.com, (Value of H)!"},
+	{"at", "@NOPE:-${H}@ @1@", "${H} ARGUMENT1"},
+	{"at", "user@host and @H@", "user@host and (Value of H)"},
+	{"percent", "%{HOME} %%{HOME} ${HOME}", "/usr/gopher %{HOME} ${HOME}"},
+	{"percent", "%{NOPE:-%{H}} %{", "(Value of H) "},
+	{"brackets", "[[HOME]] \\[[HOME]] [[ a ]] ${HOME}", "/usr/gopher [[HOME]]  ${HOME}"},
+	{"brackets", "[[NOPE:-[[H]]]]", "(Value of H)"},
+	{"brackets", "[[HOME##*/]]", "gopher"},
+}
+
+func TestExpanderSyntax(t *testing.T) {
+	for _, test := range syntaxTests {
+		e := gosubst.NewExpander(func(s string) (string, bool) {
+			val := testGetenv(s)
+			return val, val != ""
+		})
+		e.Syntax = gosubst.Syntaxes[test.syntax]
+		result, err := e.Expand(test.in)
+		if err != nil {
+			t.Errorf("Expander.Expand(%q) with syntax %s has error %q; expected nil", test.in, test.syntax, err)
+		}
+		if result != test.out {
+			t.Errorf("Expander.Expand(%q) with syntax %s == %q; expected %q", test.in, test.syntax, result, test.out)
+		}
+	}
+}
@@ -66,3 +66,23 @@ func goldenName(filename string, expand, template bool) string {
 
 	return fmt.Sprintf("%s%s%s.golden", filename, expandName, templateName)
 }
+
+func TestRenderBare(t *testing.T) {
+	resetEnvirnonment := testutils.ClearEnvironment(t)
+	defer resetEnvirnonment()
+
+	os.Setenv("APP_NAME", "nginx")
+
+	opts := gosubst.DefaultOptions()
+	opts.Bare = true
+	input := `{{ $name := "$APP_NAME" }}name: $APP_NAME, {{ $name }}, ${APP_NAME}`
+	expected := `name: nginx, $APP_NAME, nginx`
+
+	output, err := gosubst.Render(input, opts)
+	if err != nil {
+		t.Errorf("Render(%q) returned error %q; expected nil", input, err)
+	}
+	if output != expected {
+		t.Errorf("Render(%q) == %q; expected %q", input, output, expected)
+	}
+}
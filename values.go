@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+// NOTE: values files work like Helm's: each is a YAML (or JSON, which
+//       is YAML too) map, and they're deep-merged in the order given to
+//       make .Values. Maps are merged key by key; anything else (lists
+//       included) in a later file replaces what came before, and a null
+//       deletes the key.
+
+// LoadValues reads and deep-merges the values files at the given paths
+// (through FsBackend), in order.
+func LoadValues(paths ...string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, path := range paths {
+		data, err := afero.ReadFile(FsBackend, path)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := ParseValues(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		MergeValues(values, vals)
+	}
+	return values, nil
+}
+
+// ParseValues parses a YAML or JSON document, which must be a map (or
+// empty).
+func ParseValues(data []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return make(map[string]interface{}), nil
+	}
+	vals, ok := normalize(doc).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("values must be a map, not %T", doc)
+	}
+	return vals, nil
+}
+
+// normalize converts the map[interface{}]interface{}s that yaml.v2 gives
+// us into map[string]interface{}s (as JSON would), so that Sprig's dict
+// functions work on them.
+func normalize(val interface{}) interface{} {
+	switch val := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[fmt.Sprint(k)] = normalize(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range val {
+			val[i] = normalize(v)
+		}
+	}
+	return val
+}
+
+// MergeValues deep-merges src into dst.
+func MergeValues(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		srcMap, srcOK := v.(map[string]interface{})
+		dstMap, dstOK := dst[k].(map[string]interface{})
+		if srcOK && !dstOK {
+			dstMap = make(map[string]interface{})
+			dst[k] = dstMap
+		}
+		if srcOK {
+			MergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
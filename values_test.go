@@ -0,0 +1,86 @@
+package main_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+	"github.com/spf13/afero"
+)
+
+func TestLoadValues(t *testing.T) {
+	fs := gosubst.FsBackend
+	defer func() {
+		gosubst.FsBackend = fs
+	}()
+
+	gosubst.FsBackend = afero.NewMemMapFs()
+	afero.WriteFile(gosubst.FsBackend, "values.yaml", []byte(`
+name: app
+replicas: 1
+image:
+  repository: nginx
+  tag: "1.17"
+labels: [a, b]
+debug: true
+1: one
+`), 0644)
+	afero.WriteFile(gosubst.FsBackend, "prod.json", []byte(`{
+  "replicas": 3,
+  "image": {"tag": "1.19", "pullPolicy": "Always"},
+  "labels": ["c"],
+  "debug": null,
+  "resources": {"limits": {"cpu": "1"}, "requests": null}
+}`), 0644)
+	afero.WriteFile(gosubst.FsBackend, "empty.yaml", []byte("# nothing\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "list.yaml", []byte("- a\n- b\n"), 0644)
+	afero.WriteFile(gosubst.FsBackend, "bad.yaml", []byte("a: [b\n"), 0644)
+
+	values, err := gosubst.LoadValues("values.yaml", "empty.yaml", "prod.json")
+	if err != nil {
+		t.Fatalf("LoadValues() has error %q; expected nil", err)
+	}
+	expected := map[string]interface{}{
+		"name":     "app",
+		"replicas": 3,
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"tag":        "1.19",
+			"pullPolicy": "Always",
+		},
+		"labels": []interface{}{"c"},
+		"1":      "one",
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1"},
+		},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("LoadValues() ==\n%#v\nexpected\n%#v", values, expected)
+	}
+
+	errs := []struct {
+		paths []string
+		err   string
+	}{
+		{[]string{"nope.yaml"}, "file does not exist"},
+		{[]string{"values.yaml", "list.yaml"}, "list.yaml: values must be a map"},
+		{[]string{"bad.yaml"}, "bad.yaml: yaml: line"},
+	}
+	for _, test := range errs {
+		if _, err := gosubst.LoadValues(test.paths...); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("LoadValues(%q) has error %v; expected %q", test.paths, err, test.err)
+		}
+	}
+
+	opts := gosubst.DefaultOptions()
+	opts.Values = []string{"values.yaml", "prod.json"}
+	input := `{{ .Values.name }}:{{ .Values.image.tag }} x{{ .Values.replicas }} {{ .Values.labels | join "," }} {{ .Values.image | toJson }}`
+	output, err := gosubst.Render(input, opts)
+	if expected := `app:1.19 x3 c {"pullPolicy":"Always","repository":"nginx","tag":"1.19"}`; err != nil || output != expected {
+		t.Errorf("Render(%q) == %q, %v; expected %q", input, output, err, expected)
+	}
+	if output, err := gosubst.Render("{{ .Values.nope }}", gosubst.DefaultOptions()); err != nil || output != "<no value>" {
+		t.Errorf("Render() with no values == %q, %v; expected an empty .Values", output, err)
+	}
+}
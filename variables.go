@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// Variable is a reference to an environment variable found in the input,
+// as listed by --variables.
+type Variable struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"`             // "${}", "${!}", "$", or the template function, eg "env"
+	Operator string `json:"operator,omitempty"` // eg ":-", for ${VAR:-word}
+	Operand  string `json:"operand,omitempty"`  // eg "word", for ${VAR:-word}
+	Set      bool   `json:"set"`
+}
+
+// Variables lists the variables referenced by input, in the order they
+// are found: first those the expansion pass would expand, and then the
+// arguments to requiredEnvs, env and expandenv in the template. The
+// lookup function reports whether each one is set.
+func Variables(input string, opts Options, lookup func(string) (string, bool)) ([]Variable, error) {
+	var vars []Variable
+	seen := make(map[Variable]bool)
+	add := func(v Variable) {
+		_, v.Set = lookup(v.Name)
+		if !seen[v] {
+			seen[v] = true
+			vars = append(vars, v)
+		}
+	}
+
+	if opts.Expand {
+		expandVariables(opts.expander(lookup), input, add)
+	}
+
+	if opts.Template {
+		tmpl, err := template.New(inputName).
+			Funcs(sprig.TxtFuncMap()).
+			Funcs(FuncMap()).
+			Parse(input)
+		if err != nil {
+			return nil, err
+		}
+		// Walk the input itself first, and then anything it defines.
+		templates := tmpl.Templates()
+		sort.Slice(templates, func(i, j int) bool {
+			if templates[i] == tmpl || templates[j] == tmpl {
+				return templates[i] == tmpl
+			}
+			return templates[i].Name() < templates[j].Name()
+		})
+		for _, t := range templates {
+			if t.Tree != nil {
+				templateVariables(t.Tree.Root, add)
+			}
+		}
+	}
+
+	return vars, nil
+}
+
+// expandVariables adds the references the Expander would expand in s,
+// including those nested in their names and operands. For ${!REF}, that
+// is REF itself, rather than the variable it names. Nested names are
+// expanded without any resolvers, so listing never runs a ${cmd:...}.
+func expandVariables(e *Expander, s string, add func(Variable)) {
+	plain := *e
+	plain.Resolvers = nil
+	e.walk(s, func(start, end int, ref *reference) error {
+		if ref.nested {
+			expandVariables(e, ref.name, add)
+			name, err := plain.Expand(ref.name)
+			if err != nil || !isName(name) {
+				return nil
+			}
+			ref.name = name
+		}
+		if ref.name == "" || !e.allows(ref.name) {
+			return nil
+		}
+		if ref.scheme != "" {
+			// Not a variable, but its argument may refer to some.
+			expandVariables(e, ref.word, add)
+			return nil
+		}
+		v := Variable{Name: ref.name, Source: "${}", Operator: ref.op, Operand: ref.word}
+		if ref.indirect {
+			v.Source = "${!}"
+		}
+		switch {
+		case ref.bare:
+			v.Source = "$"
+		case ref.length:
+			v.Operator = "#"
+		case ref.op == "/" || ref.op == "//" || ref.op == "/#" || ref.op == "/%":
+			v.Operand = ref.word + "/" + ref.arg
+		case ref.hasArg:
+			v.Operand = ref.word + ":" + ref.arg
+		}
+		add(v)
+		expandVariables(e, ref.word, add)
+		expandVariables(e, ref.arg, add)
+		return nil
+	})
+}
+
+// templateVariables walks a parsed template, adding the variables named
+// by calls to requiredEnvs, env and expandenv.
+func templateVariables(node parse.Node, add func(Variable)) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			templateVariables(n, add)
+		}
+	case *parse.ActionNode:
+		templateVariables(node.Pipe, add)
+	case *parse.IfNode:
+		templateVariables(&node.BranchNode, add)
+	case *parse.RangeNode:
+		templateVariables(&node.BranchNode, add)
+	case *parse.WithNode:
+		templateVariables(&node.BranchNode, add)
+	case *parse.BranchNode:
+		templateVariables(node.Pipe, add)
+		templateVariables(node.List, add)
+		templateVariables(node.ElseList, add)
+	case *parse.TemplateNode:
+		templateVariables(node.Pipe, add)
+	case *parse.ChainNode:
+		templateVariables(node.Node, add)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for i, cmd := range node.Cmds {
+			args := cmd.Args
+			// Catch "HOME" | env, where the name is piped in.
+			if i > 0 && len(node.Cmds[i-1].Args) == 1 {
+				args = append(args[:len(args):len(args)], node.Cmds[i-1].Args[0])
+			}
+			commandVariables(args, add)
+			for _, arg := range cmd.Args {
+				templateVariables(arg, add)
+			}
+		}
+	}
+}
+
+// commandVariables adds the variables named by a single command, if it
+// calls one of the functions that reads the environment.
+func commandVariables(args []parse.Node, add func(Variable)) {
+	if len(args) < 2 {
+		return
+	}
+	ident, ok := args[0].(*parse.IdentifierNode)
+	if !ok {
+		return
+	}
+	for _, arg := range args[1:] {
+		str, ok := arg.(*parse.StringNode)
+		if !ok {
+			continue
+		}
+		switch ident.Ident {
+		case "requiredEnvs", "env":
+			add(Variable{Name: str.Text, Source: ident.Ident})
+		case "expandenv":
+			os.Expand(str.Text, func(name string) string {
+				add(Variable{Name: name, Source: ident.Ident})
+				return ""
+			})
+		}
+	}
+}
+
+// PrintVariables writes the names of the given variables one per line,
+// or if asJSON is set, writes them all out as a JSON array.
+func PrintVariables(w io.Writer, vars []Variable, asJSON bool) error {
+	if asJSON {
+		if vars == nil {
+			vars = []Variable{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(vars)
+	}
+	printed := make(map[string]bool)
+	for _, v := range vars {
+		if !printed[v.Name] {
+			printed[v.Name] = true
+			if _, err := fmt.Fprintln(w, v.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	gosubst "github.com/hews/gosubst"
+)
+
+func TestVariables(t *testing.T) {
+	input := `name: ${APP_NAME}
+image: nginx:${NGINX_VERSION:-latest}
+tag: ${IMAGE##*/} ${IMAGE/a/b} ${IMAGE:0:2} ${#IMAGE} ${X:-${Y}} $${ESCAPED}
+{{- requiredEnvs "APP_NAME" "PORT" }}
+{{- if env "DEBUG" }}{{ expandenv "$HOME/$CONF" }}{{ end }}
+{{- define "x" }}{{ "TERM" | env }}{{ end }}
+{{- range $x := list (env "LIST") }}{{ end }}`
+
+	expected := []gosubst.Variable{
+		{Name: "APP_NAME", Source: "${}", Set: true},
+		{Name: "NGINX_VERSION", Source: "${}", Operator: ":-", Operand: "latest"},
+		{Name: "IMAGE", Source: "${}", Operator: "##", Operand: "*/"},
+		{Name: "IMAGE", Source: "${}", Operator: "/", Operand: "a/b"},
+		{Name: "IMAGE", Source: "${}", Operator: ":", Operand: "0:2"},
+		{Name: "IMAGE", Source: "${}", Operator: "#"},
+		{Name: "X", Source: "${}", Operator: ":-", Operand: "${Y}"},
+		{Name: "Y", Source: "${}"},
+		{Name: "APP_NAME", Source: "requiredEnvs", Set: true},
+		{Name: "PORT", Source: "requiredEnvs"},
+		{Name: "DEBUG", Source: "env"},
+		{Name: "HOME", Source: "expandenv", Set: true},
+		{Name: "CONF", Source: "expandenv"},
+		{Name: "LIST", Source: "env"},
+		{Name: "TERM", Source: "env"},
+	}
+
+	lookup := func(name string) (string, bool) {
+		return "", name == "APP_NAME" || name == "HOME"
+	}
+	vars, err := gosubst.Variables(input, gosubst.DefaultOptions(), lookup)
+	if err != nil {
+		t.Fatalf("Variables() returned error %q; expected nil", err)
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Variables() ==\n%+v\nexpected\n%+v", vars, expected)
+	}
+
+	var out bytes.Buffer
+	gosubst.PrintVariables(&out, vars, false)
+	names := "APP_NAME\nNGINX_VERSION\nIMAGE\nX\nY\nPORT\nDEBUG\nHOME\nCONF\nLIST\nTERM\n"
+	if out.String() != names {
+		t.Errorf("PrintVariables() printed %q; expected %q", out.String(), names)
+	}
+}
+
+func TestVariablesOptions(t *testing.T) {
+	input := "$HOME ${host} ${APP_NAME} {{ $x := 1 }}{{ env \"TERM\" }}"
+	lookup := func(string) (string, bool) { return "", false }
+
+	opts := gosubst.DefaultOptions()
+	opts.Template = false
+	opts.Bare = true
+	opts.Except = []string{"host"}
+
+	expected := []gosubst.Variable{
+		{Name: "HOME", Source: "$"},
+		{Name: "APP_NAME", Source: "${}"},
+	}
+	vars, err := gosubst.Variables(input, opts, lookup)
+	if err != nil {
+		t.Fatalf("Variables() returned error %q; expected nil", err)
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Variables() ==\n%+v\nexpected\n%+v", vars, expected)
+	}
+
+	if _, err := gosubst.Variables("{{ if }}", gosubst.DefaultOptions(), lookup); err == nil {
+		t.Errorf("Variables() of an invalid template returned nil; expected an error")
+	}
+}
+
+func TestVariablesNested(t *testing.T) {
+	input := "${DB_${DEPLOY_ENV}_HOST} ${!REF:-x}"
+	lookup := func(name string) (string, bool) {
+		return map[string]string{"DEPLOY_ENV": "PROD", "REF": "HOME"}[name], name != "DB_PROD_HOST"
+	}
+	opts := gosubst.DefaultOptions()
+	opts.Template = false
+
+	expected := []gosubst.Variable{
+		{Name: "DEPLOY_ENV", Source: "${}", Set: true},
+		{Name: "DB_PROD_HOST", Source: "${}"},
+		{Name: "REF", Source: "${!}", Operator: ":-", Operand: "x", Set: true},
+	}
+	vars, err := gosubst.Variables(input, opts, lookup)
+	if err != nil {
+		t.Fatalf("Variables() returned error %q; expected nil", err)
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Variables() ==\n%+v\nexpected\n%+v", vars, expected)
+	}
+}
+
+func TestVariablesDontResolve(t *testing.T) {
+	resolved := false
+	gosubst.RegisterResolver("probe", gosubst.ResolverFunc(func(arg string) (string, error) {
+		resolved = true
+		return arg, nil
+	}))
+	defer gosubst.RegisterResolver("probe", nil)
+	opts := gosubst.DefaultOptions()
+	opts.Template = false
+
+	expected := []gosubst.Variable{{Name: "FULL", Source: "${}", Set: true}}
+	vars, err := gosubst.Variables("${X_${probe:hi}} ${probe:${FULL}}", opts, testLookupEnv)
+	if err != nil {
+		t.Fatalf("Variables() returned error %q; expected nil", err)
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Variables() ==\n%+v\nexpected\n%+v", vars, expected)
+	}
+	if resolved {
+		t.Errorf("Variables() resolved a scheme; expected it not to")
+	}
+}
+
+func TestPrintVariablesJSON(t *testing.T) {
+	var out bytes.Buffer
+	gosubst.PrintVariables(&out, nil, true)
+	if out.String() != "[]\n" {
+		t.Errorf("PrintVariables() printed %q; expected %q", out.String(), "[]\n")
+	}
+
+	out.Reset()
+	gosubst.PrintVariables(&out, []gosubst.Variable{{Name: "A", Source: "${}", Operator: ":-", Operand: "b"}}, true)
+	expected := `[
+  {
+    "name": "A",
+    "source": "${}",
+    "operator": ":-",
+    "operand": "b",
+    "set": false
+  }
+]
+`
+	if out.String() != expected {
+		t.Errorf("PrintVariables() printed %q; expected %q", out.String(), expected)
+	}
+}